@@ -1,6 +1,6 @@
 #!/bin/bash
 
-SOURCES="main.go config.go"
+SOURCES="main.go config.go waiters.go steps.go export.go iam.go versions.go build.go status.go destroy.go backup.go auth.go keys.go signing.go jwt.go"
 
 OUTPUT=bin
 
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/apigatewayv2"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lmbdtypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+/*
+ * Authentication on an existing deployment (subcommand auth)
+ *
+ *  - enable: create (or update) the secret, deploy the authorizer lambda
+ *    (if not already deployed), create the authorizer and attach it to the
+ *    route, pass client identity to the state machine. On an existing
+ *    authorizer, only its result caching ttl (-ttl) and identity source
+ *    (-mode) are updated. With -mode jwt, the JWT authorizer is created (or
+ *    updated) and attached to every route instead, see jwt.go
+ *  - disable: detach the authorizer (either kind) from the routes and delete
+ *    it, secret and authorizer lambda are kept (see -delete-lambda)
+ *  - rotate: update the key of the default client only, auth mode is kept
+ *  - add, revoke, list: manage per-client keys (see keys.go)
+ *
+ * The rest of the stack is not touched at all
+ */
+
+func isLambdaDeployed(name *string) (bool, error) {
+	gfi := lambda.GetFunctionInput{FunctionName: name}
+	_, err := svc.lambda.GetFunction(dflCtx(), &gfi)
+	if err == nil {
+		return true, nil
+	}
+
+	var notFound *lmbdtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func deployAuthorizerLambda(baseDir string, maxWait time.Duration) error {
+	name := authorizerLambda.FunctionName
+
+	deployed, err := isLambdaDeployed(name)
+	if err != nil {
+		return err
+	}
+
+	if deployed {
+		log.Printf("existing lambda %s (use -u %s to update it)\n", *name, *name)
+	} else {
+		if !createLambda(authorizerLambda, baseDir) {
+			return fmt.Errorf("unable to create lambda %s", *name)
+		}
+
+		waitLambdaActive(name, maxWait)
+	}
+
+	return createLambdaAlias(name)
+}
+
+func updateAuthorizer(apiId *string, authorizerId *string) error {
+	uai := apigatewayv2.UpdateAuthorizerInput{
+		ApiId:                        apiId,
+		AuthorizerId:                 authorizerId,
+		AuthorizerResultTtlInSeconds: authorizer.AuthorizerResultTtlInSeconds,
+		IdentitySource:               authorizer.IdentitySource,
+	}
+	if _, err := svc.apigateway.UpdateAuthorizer(dflCtx(), &uai); err != nil {
+		return err
+	}
+
+	log.Printf("update authorizer %s, ttl: %d sec, identity source: %s\n", *authorizerId,
+		*authorizer.AuthorizerResultTtlInSeconds, strings.Join(authorizer.IdentitySource, ","))
+
+	return nil
+}
+
+func enableAuth(key string, mode string, baseDir string, leastPrivilege bool,
+	maxWait time.Duration) error {
+	apiId, err := getApiId()
+	if err != nil {
+		return err
+	}
+
+	obtainIamRole()
+	addAuthorizerLambda()
+	createRoles(leastPrivilege)
+
+	if err := createOrUpdateSecret(&key, mode); err != nil {
+		return err
+	}
+
+	if mode == AUTH_MODE_HMAC {
+		createNonceTable(maxWait)
+	}
+
+	if err := deployAuthorizerLambda(baseDir, maxWait); err != nil {
+		return err
+	}
+
+	// JWT authorizer (if any) would keep guarding the other routes
+	deleteJwtAuthorizer(apiId)
+
+	authorizerId, err := getAuthorizerId(apiId)
+	if err != nil {
+		authorizerId = createAuthorizer(apiId)
+		if authorizerId == nil {
+			return errors.New("unable to create authorizer")
+		}
+	} else {
+		log.Printf("existing authorizer %s, id: %s\n", *authorizer.Name, *authorizerId)
+
+		if err := updateAuthorizer(apiId, authorizerId); err != nil {
+			return err
+		}
+	}
+
+	routeId, err := getRouteId(apiId)
+	if err != nil {
+		return err
+	}
+
+	route.ApiId = apiId
+	addAuthorizerToRoute(authorizerId, routeId)
+
+	return updateIntegrationInput(apiId, getAuthIntegrationInput(mode))
+}
+
+func disableAuth(deleteAuthorizerLambda bool) error {
+	apiId, err := getApiId()
+	if err != nil {
+		return err
+	}
+
+	deleteAuthorizer(apiId)
+	deleteJwtAuthorizer(apiId)
+
+	if err := updateIntegrationInput(apiId, INTEGRATION_INPUT); err != nil {
+		log.Printf("unable to reset integration input: %v\n", err)
+	}
+
+	if deleteAuthorizerLambda {
+		deleteLambda(authorizerLambda.FunctionName)
+	}
+
+	return nil
+}
+
+func authMain(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s auth enable|disable|rotate|add|revoke|list [options]\n",
+			os.Args[0])
+	}
+
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	action := args[0]
+
+	fs := flag.NewFlagSet("auth "+action, flag.ExitOnError)
+
+	var key, baseDir, clientId *string
+	var leastPrivilege, deleteLambda *bool
+	var authTtl *int
+	var mode, jwtIssuer, jwtAudience, jwtScopes, jwtReadScopes *string
+	var waitTimeout, validFor *time.Duration
+
+	switch action {
+	case "enable":
+		key = fs.String("a", "",
+			"Key to be entered on \"Authorization\" http header (required, unless -mode jwt)")
+		baseDir = fs.String("p", "../../lambdas/pkgs", "BaseDir for built lambda deployment packages")
+		leastPrivilege = fs.Bool("r", false,
+			"Create (or update) least-privilege IAM roles, as deploy -r does")
+		waitTimeout = fs.Duration("w", 5*time.Minute,
+			"Max time to wait for the authorizer lambda to become ACTIVE. 0 to not wait at all")
+		authTtl = fs.Int("ttl", 0,
+			"Seconds API Gateway caches authorization results for (0: no caching)")
+		mode = fs.String("mode", AUTH_MODE_KEY,
+			"How producers authenticate: "+AUTH_MODE_KEY+" (key sent as is), "+
+				AUTH_MODE_HMAC+" (signed requests, the secret then holds signing keys: not hashed at rest) or "+
+				AUTH_MODE_JWT+" (OIDC tokens)")
+		jwtIssuer = fs.String("issuer", "", "Along with -mode jwt, https url of the token issuer")
+		jwtAudience = fs.String("audience", "",
+			"Along with -mode jwt, comma-separated audiences, tokens must be issued for one of them")
+		jwtScopes = fs.String("scopes", JWT_INGEST_SCOPE,
+			"Along with -mode jwt, comma-separated scopes required to ingest (POST /store)")
+		jwtReadScopes = fs.String("read-scopes", JWT_READ_SCOPE,
+			"Along with -mode jwt, comma-separated scopes required on read (GET) routes")
+	case "disable":
+		deleteLambda = fs.Bool("delete-lambda", false, "Also delete the authorizer lambda")
+	case "rotate":
+		key = fs.String("a", "", "New key to be entered on \"Authorization\" http header (required)")
+	case "add":
+		clientId = fs.String("client", "", "Client (producer) id the key identifies (required)")
+		key = fs.String("a", "", "Key of the client. If empty, a random one is generated and printed")
+		validFor = fs.Duration("expires", 0, "Key validity (e.g. 720h). 0 for no expiration")
+	case "revoke":
+		clientId = fs.String("client", "", "Client (producer) id whose key is revoked (required)")
+	case "list":
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	fs.Parse(args[1:])
+
+	if clientId != nil && len(*clientId) == 0 {
+		log.Fatalln("client id (-client) is required")
+	}
+
+	if action == "add" {
+		if err := checkClientId(*clientId); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	generatedKey := false
+	if action == "add" && len(*key) == 0 {
+		generated, err := generateKey()
+		if err != nil {
+			log.Fatalf("unable to generate key: %v", err)
+		}
+
+		*key = generated
+		generatedKey = true
+	}
+
+	if action == "enable" && *mode == AUTH_MODE_JWT {
+		setJwtConfig(*jwtIssuer, *jwtAudience, *jwtScopes, *jwtReadScopes)
+	} else if key != nil && len(*key) == 0 {
+		log.Fatalln("key (-a) is required")
+	}
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	var err error
+
+	switch action {
+	case "enable":
+		setAuthorizerTtl(*authTtl)
+		setAuthMode(*mode)
+		if *mode == AUTH_MODE_JWT {
+			err = enableJwtAuth()
+		} else {
+			err = enableAuth(*key, *mode, *baseDir, *leastPrivilege, *waitTimeout)
+		}
+	case "disable":
+		err = disableAuth(*deleteLambda)
+	case "rotate":
+		err = createOrUpdateSecret(key, "")
+	case "add":
+		err = addClientKey(*clientId, *key, *validFor)
+		if err == nil && generatedKey {
+			// only once stored
+			fmt.Printf("key of client %s (shown only once): %s\n", *clientId, *key)
+		}
+	case "revoke":
+		err = revokeClientKey(*clientId)
+	case "list":
+		err = listClientKeys()
+	}
+
+	if err != nil {
+		log.Fatalf("auth %s failed: %v", action, err)
+	}
+}
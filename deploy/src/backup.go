@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+/*
+ * Backup and restore of pipeline tables (subcommands backup and restore)
+ *
+ * Tables are exported (paginated Scan) to local files, one per table:
+ *
+ *  - <table>.ndjson: one item per line, DynamoDB JSON (each attribute value
+ *    tagged by its type, e.g. {"S": "..."}), so restore is lossless
+ *  - <table>.parquet: one column per attribute, strings as UTF8, numbers as
+ *    DOUBLE, booleans as BOOLEAN, anything else (and attributes whose type
+ *    varies among items) as DynamoDB JSON in a UTF8 column. Types are kept
+ *    in the file metadata (PARQUET_TYPES_KEY) for restore. Since the schema
+ *    must be known before writing, the whole table is held in memory
+ *
+ * Restore re-imports them with BatchWriteItem into the (already deployed)
+ * tables, overwriting items with the same key.
+ *
+ * See also option -pitr, enabling point-in-time recovery on deployed tables
+ */
+
+const BACKUP_FORMAT_NDJSON = "ndjson"
+const BACKUP_FORMAT_PARQUET = "parquet"
+
+const PARQUET_TYPES_KEY = "dynamodb.types"
+const PARQUET_JSON_TYPE = "JSON"
+
+// BatchWriteItem accepts at most 25 items
+const BATCH_WRITE_MAX_ITEMS = 25
+const BATCH_WRITE_MAX_RETRIES = 8
+
+func enablePointInTimeRecovery() {
+	for _, table := range tables {
+		ucbi := dynamodb.UpdateContinuousBackupsInput{
+			TableName: table.TableName,
+			PointInTimeRecoverySpecification: &ddbtypes.PointInTimeRecoverySpecification{
+				PointInTimeRecoveryEnabled: aws.Bool(true),
+			},
+		}
+
+		_, err := svc.dynamodb.UpdateContinuousBackups(dflCtx(), &ucbi)
+		if err != nil {
+			log.Printf("unable to enable point-in-time recovery on table %s: %v\n",
+				*table.TableName, err)
+		} else {
+			log.Printf("enable point-in-time recovery on table %s\n", *table.TableName)
+		}
+	}
+}
+
+/*
+ * DynamoDB JSON
+ */
+
+func attributeValueToJson(av ddbtypes.AttributeValue) interface{} {
+	switch v := av.(type) {
+	case *ddbtypes.AttributeValueMemberS:
+		return map[string]interface{}{"S": v.Value}
+	case *ddbtypes.AttributeValueMemberN:
+		return map[string]interface{}{"N": v.Value}
+	case *ddbtypes.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": v.Value}
+	case *ddbtypes.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": v.Value}
+	case *ddbtypes.AttributeValueMemberB:
+		return map[string]interface{}{"B": v.Value}
+	case *ddbtypes.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": v.Value}
+	case *ddbtypes.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": v.Value}
+	case *ddbtypes.AttributeValueMemberBS:
+		return map[string]interface{}{"BS": v.Value}
+	case *ddbtypes.AttributeValueMemberL:
+		var list []interface{}
+		for _, elem := range v.Value {
+			list = append(list, attributeValueToJson(elem))
+		}
+		return map[string]interface{}{"L": list}
+	case *ddbtypes.AttributeValueMemberM:
+		return map[string]interface{}{"M": itemToJson(v.Value)}
+	}
+
+	return nil
+}
+
+func itemToJson(item map[string]ddbtypes.AttributeValue) map[string]interface{} {
+	jsonItem := make(map[string]interface{})
+	for name, av := range item {
+		jsonItem[name] = attributeValueToJson(av)
+	}
+
+	return jsonItem
+}
+
+// Same as DynamoDB JSON, binary values being base64 encoded
+type JsonAttributeValue struct {
+	S    *string                       `json:"S,omitempty"`
+	N    *string                       `json:"N,omitempty"`
+	BOOL *bool                         `json:"BOOL,omitempty"`
+	NULL *bool                         `json:"NULL,omitempty"`
+	B    []byte                        `json:"B,omitempty"`
+	SS   []string                      `json:"SS,omitempty"`
+	NS   []string                      `json:"NS,omitempty"`
+	BS   [][]byte                      `json:"BS,omitempty"`
+	L    []JsonAttributeValue          `json:"L,omitempty"`
+	M    map[string]JsonAttributeValue `json:"M,omitempty"`
+}
+
+func jsonToAttributeValue(jav *JsonAttributeValue) (ddbtypes.AttributeValue, error) {
+	switch {
+	case jav.S != nil:
+		return &ddbtypes.AttributeValueMemberS{Value: *jav.S}, nil
+	case jav.N != nil:
+		return &ddbtypes.AttributeValueMemberN{Value: *jav.N}, nil
+	case jav.BOOL != nil:
+		return &ddbtypes.AttributeValueMemberBOOL{Value: *jav.BOOL}, nil
+	case jav.NULL != nil:
+		return &ddbtypes.AttributeValueMemberNULL{Value: *jav.NULL}, nil
+	case jav.B != nil:
+		return &ddbtypes.AttributeValueMemberB{Value: jav.B}, nil
+	case jav.SS != nil:
+		return &ddbtypes.AttributeValueMemberSS{Value: jav.SS}, nil
+	case jav.NS != nil:
+		return &ddbtypes.AttributeValueMemberNS{Value: jav.NS}, nil
+	case jav.BS != nil:
+		return &ddbtypes.AttributeValueMemberBS{Value: jav.BS}, nil
+	case jav.L != nil:
+		list := make([]ddbtypes.AttributeValue, 0, len(jav.L))
+		for i := range jav.L {
+			elem, err := jsonToAttributeValue(&jav.L[i])
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+		return &ddbtypes.AttributeValueMemberL{Value: list}, nil
+	case jav.M != nil:
+		item, err := jsonToItem(jav.M)
+		if err != nil {
+			return nil, err
+		}
+		return &ddbtypes.AttributeValueMemberM{Value: item}, nil
+	}
+
+	return nil, errors.New("attribute value with unknown type")
+}
+
+func jsonToItem(jsonItem map[string]JsonAttributeValue) (map[string]ddbtypes.AttributeValue, error) {
+	item := make(map[string]ddbtypes.AttributeValue)
+	for name, jav := range jsonItem {
+		av, err := jsonToAttributeValue(&jav)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", name, err)
+		}
+		item[name] = av
+	}
+
+	return item, nil
+}
+
+/*
+ * Backup
+ */
+
+// Paginated scan, each page of items is handed to onPage
+func scanTable(table *string, onPage func([]map[string]ddbtypes.AttributeValue) error) (int, error) {
+	si := dynamodb.ScanInput{TableName: table}
+	count := 0
+
+	for {
+		sOut, err := svc.dynamodb.Scan(dflCtx(), &si)
+		if err != nil {
+			return count, err
+		}
+
+		if err := onPage(sOut.Items); err != nil {
+			return count, err
+		}
+		count += len(sOut.Items)
+
+		si.ExclusiveStartKey = sOut.LastEvaluatedKey
+		if len(si.ExclusiveStartKey) == 0 {
+			break
+		}
+	}
+
+	return count, nil
+}
+
+func backupTableNdjson(table *string, out io.Writer) (int, error) {
+	enc := json.NewEncoder(out)
+
+	return scanTable(table, func(items []map[string]ddbtypes.AttributeValue) error {
+		for _, item := range items {
+			if err := enc.Encode(itemToJson(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getParquetType(av ddbtypes.AttributeValue) string {
+	switch av.(type) {
+	case *ddbtypes.AttributeValueMemberS:
+		return "S"
+	case *ddbtypes.AttributeValueMemberN:
+		return "N"
+	case *ddbtypes.AttributeValueMemberBOOL:
+		return "BOOL"
+	}
+
+	return PARQUET_JSON_TYPE
+}
+
+func getParquetNode(typ string) parquet.Node {
+	switch typ {
+	case "N":
+		return parquet.Optional(parquet.Leaf(parquet.DoubleType))
+	case "BOOL":
+		return parquet.Optional(parquet.Leaf(parquet.BooleanType))
+	}
+
+	return parquet.Optional(parquet.String())
+}
+
+func getParquetValue(typ string, av ddbtypes.AttributeValue) (parquet.Value, error) {
+	switch v := av.(type) {
+	case *ddbtypes.AttributeValueMemberS:
+		if typ == "S" {
+			return parquet.ValueOf(v.Value), nil
+		}
+	case *ddbtypes.AttributeValueMemberN:
+		if typ == "N" {
+			num, err := strconv.ParseFloat(v.Value, 64)
+			return parquet.ValueOf(num), err
+		}
+	case *ddbtypes.AttributeValueMemberBOOL:
+		if typ == "BOOL" {
+			return parquet.ValueOf(v.Value), nil
+		}
+	}
+
+	jsonBytes, err := json.Marshal(attributeValueToJson(av))
+	return parquet.ValueOf(string(jsonBytes)), err
+}
+
+func backupTableParquet(table *string, out io.Writer) (int, error) {
+	var items []map[string]ddbtypes.AttributeValue
+
+	count, err := scanTable(table, func(page []map[string]ddbtypes.AttributeValue) error {
+		items = append(items, page...)
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, writeParquetItems(table, items, out)
+}
+
+func writeParquetItems(table *string, items []map[string]ddbtypes.AttributeValue, out io.Writer) error {
+	// attribute types, JSON if it varies among items
+	types := make(map[string]string)
+	for _, item := range items {
+		for name, av := range item {
+			typ := getParquetType(av)
+			if prev, ok := types[name]; ok && prev != typ {
+				typ = PARQUET_JSON_TYPE
+			}
+			types[name] = typ
+		}
+	}
+
+	// columns are ordered by name (same as parquet.Group does)
+	var columns []string
+	group := parquet.Group{}
+	for name, typ := range types {
+		columns = append(columns, name)
+		group[name] = getParquetNode(typ)
+	}
+	sort.Strings(columns)
+
+	typesBytes, err := json.Marshal(types)
+	if err != nil {
+		return err
+	}
+
+	writer := parquet.NewWriter(out,
+		parquet.NewSchema(*table, group),
+		parquet.KeyValueMetadata(PARQUET_TYPES_KEY, string(typesBytes)))
+
+	for _, item := range items {
+		row := make(parquet.Row, 0, len(columns))
+		for idx, name := range columns {
+			av, ok := item[name]
+			if !ok {
+				row = append(row, parquet.NullValue().Level(0, 0, idx))
+				continue
+			}
+
+			value, err := getParquetValue(types[name], av)
+			if err != nil {
+				return fmt.Errorf("attribute %s: %v", name, err)
+			}
+			row = append(row, value.Level(0, 1, idx))
+		}
+
+		if _, err := writer.WriteRows([]parquet.Row{row}); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+func getBackupPath(dir string, table *string, format string) string {
+	return filepath.Join(dir, *table+"."+format)
+}
+
+func backupTable(dir string, table *string, format string) error {
+	path := getBackupPath(dir, table, format)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out := bufio.NewWriter(file)
+
+	var count int
+	if format == BACKUP_FORMAT_PARQUET {
+		count, err = backupTableParquet(table, out)
+	} else {
+		count, err = backupTableNdjson(table, out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("backup table %s to %s, %d items\n", *table, path, count)
+
+	return nil
+}
+
+/*
+ * Restore
+ */
+
+func readNdjsonItems(path string) ([]map[string]ddbtypes.AttributeValue, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var items []map[string]ddbtypes.AttributeValue
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var jsonItem map[string]JsonAttributeValue
+		if err := dec.Decode(&jsonItem); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("item %d: %v", len(items)+1, err)
+		}
+
+		item, err := jsonToItem(jsonItem)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %v", len(items)+1, err)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func getAttributeValue(typ string, value parquet.Value) (ddbtypes.AttributeValue, error) {
+	switch typ {
+	case "S":
+		return &ddbtypes.AttributeValueMemberS{Value: value.String()}, nil
+	case "N":
+		return &ddbtypes.AttributeValueMemberN{
+			Value: strconv.FormatFloat(value.Double(), 'f', -1, 64),
+		}, nil
+	case "BOOL":
+		return &ddbtypes.AttributeValueMemberBOOL{Value: value.Boolean()}, nil
+	}
+
+	var jav JsonAttributeValue
+	if err := json.Unmarshal(value.ByteArray(), &jav); err != nil {
+		return nil, err
+	}
+
+	return jsonToAttributeValue(&jav)
+}
+
+func readParquetItems(path string) ([]map[string]ddbtypes.AttributeValue, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	pf, err := parquet.OpenFile(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	typesJson, ok := pf.Lookup(PARQUET_TYPES_KEY)
+	if !ok {
+		return nil, fmt.Errorf("missing %s metadata (not a table backup?)", PARQUET_TYPES_KEY)
+	}
+
+	var types map[string]string
+	if err := json.Unmarshal([]byte(typesJson), &types); err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	for _, path := range pf.Schema().Columns() {
+		columns = append(columns, strings.Join(path, "."))
+	}
+
+	reader := parquet.NewReader(pf)
+	defer reader.Close()
+
+	var items []map[string]ddbtypes.AttributeValue
+
+	rows := make([]parquet.Row, 64)
+	for {
+		n, err := reader.ReadRows(rows)
+
+		for _, row := range rows[:n] {
+			item := make(map[string]ddbtypes.AttributeValue)
+			for _, value := range row {
+				if value.IsNull() {
+					continue
+				}
+
+				name := columns[value.Column()]
+				av, err := getAttributeValue(types[name], value)
+				if err != nil {
+					return nil, fmt.Errorf("item %d, attribute %s: %v", len(items)+1, name, err)
+				}
+				item[name] = av
+			}
+
+			items = append(items, item)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// Write items 25 at a time, retrying unprocessed ones (throttling)
+func batchWriteItems(table *string, items []map[string]ddbtypes.AttributeValue) error {
+	for begin := 0; begin < len(items); begin += BATCH_WRITE_MAX_ITEMS {
+		end := min(begin+BATCH_WRITE_MAX_ITEMS, len(items))
+
+		var requests []ddbtypes.WriteRequest
+		for _, item := range items[begin:end] {
+			requests = append(requests, ddbtypes.WriteRequest{
+				PutRequest: &ddbtypes.PutRequest{Item: item},
+			})
+		}
+
+		bwii := dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]ddbtypes.WriteRequest{*table: requests},
+		}
+
+		delay := 100 * time.Millisecond
+		for retry := 0; ; retry++ {
+			bwiOut, err := svc.dynamodb.BatchWriteItem(dflCtx(), &bwii)
+			if err != nil {
+				return err
+			}
+
+			if len(bwiOut.UnprocessedItems) == 0 {
+				break
+			}
+
+			if retry == BATCH_WRITE_MAX_RETRIES {
+				return fmt.Errorf("items %d-%d still unprocessed after %d retries",
+					begin, end-1, retry)
+			}
+
+			time.Sleep(delay)
+			delay *= 2
+
+			bwii.RequestItems = bwiOut.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+func restoreTable(dir string, table *string) error {
+	var items []map[string]ddbtypes.AttributeValue
+	var err error
+
+	path := getBackupPath(dir, table, BACKUP_FORMAT_NDJSON)
+	if _, statErr := os.Stat(path); statErr == nil {
+		items, err = readNdjsonItems(path)
+	} else {
+		path = getBackupPath(dir, table, BACKUP_FORMAT_PARQUET)
+		items, err = readParquetItems(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := batchWriteItems(table, items); err != nil {
+		return err
+	}
+
+	log.Printf("restore table %s from %s, %d items\n", *table, path, len(items))
+
+	return nil
+}
+
+func getBackupTables(csl string) []*string {
+	if csl == "all" {
+		var tableNames []*string
+		for _, table := range tables {
+			tableNames = append(tableNames, table.TableName)
+		}
+		return tableNames
+	}
+
+	var tableNames []*string
+	for _, name := range strings.Split(csl, ",") {
+		name = strings.TrimSpace(name)
+
+		found := false
+		for _, table := range tables {
+			if *table.TableName == name {
+				tableNames = append(tableNames, table.TableName)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			log.Fatalf("unknown table %s", name)
+		}
+	}
+
+	return tableNames
+}
+
+func backupMain(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+
+	dir := fs.String("o", "backup-"+time.Now().UTC().Format("20060102T150405Z"),
+		"Directory to write table backups to")
+	format := fs.String("format", BACKUP_FORMAT_NDJSON,
+		"Backup format: "+BACKUP_FORMAT_NDJSON+" or "+BACKUP_FORMAT_PARQUET)
+	csl := fs.String("t", "all", "Comma-separated tables to backup or all")
+
+	fs.Parse(args)
+
+	if *format != BACKUP_FORMAT_NDJSON && *format != BACKUP_FORMAT_PARQUET {
+		log.Fatalf("unknown backup format %s", *format)
+	}
+
+	tableNames := getBackupTables(*csl)
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		log.Fatalf("unable to create directory %s: %v", *dir, err)
+	}
+
+	failed := false
+	for _, table := range tableNames {
+		if err := backupTable(*dir, table, *format); err != nil {
+			log.Printf("unable to backup table %s: %v\n", *table, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func restoreMain(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+
+	dir := fs.String("i", "", "Directory to read table backups from (<table>.ndjson or <table>.parquet)")
+	csl := fs.String("t", "all", "Comma-separated tables to restore or all")
+
+	fs.Parse(args)
+
+	if len(*dir) == 0 {
+		log.Fatalln("backup directory (-i) is required")
+	}
+
+	tableNames := getBackupTables(*csl)
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	failed := false
+	for _, table := range tableNames {
+		if err := restoreTable(*dir, table); err != nil {
+			log.Printf("unable to restore table %s: %v\n", *table, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * Build lambda deployment packages (subcommand build)
+ *
+ * Same as ../../lambdas/build-pkg.nix.sh: each lambda module is cross-compiled
+ * (GOOS=linux, no cgo) with tags lambda.norpc and, unless disabled,
+ * ENABLE_FAILSIM, then packaged as pkgs/<name>/<name>-<goarch>.zip
+ *
+ * Packages are reproducible: same sources and toolchain give the very same
+ * zip (no paths, build ids or timestamps), so its hash (sha256, base64 encoded
+ * as lambda CodeSha256, written next to the zip as <zip>.sha256) can be
+ * compared to the deployed one, see coreUpdateLambda
+ */
+
+const BOOTSTRAP = "bootstrap"
+
+// Fixed modification time of zip entries (earliest time zip supports)
+var zipEntryTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Lambda CodeSha256 of a deployment package
+func getCodeSha256(zipBytes []byte) string {
+	sum := sha256.Sum256(zipBytes)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func getBuildTags(failsim bool) string {
+	tags := "lambda.norpc"
+	if failsim {
+		tags += ",ENABLE_FAILSIM"
+	}
+
+	return tags
+}
+
+func compileLambda(srcs string, pkgs string, name string, goArch string, failsim bool) (string, error) {
+	bootstrap, err := filepath.Abs(filepath.Join(pkgs, name, "bin-linux-"+goArch, BOOTSTRAP))
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("go", "build",
+		"-tags="+getBuildTags(failsim),
+		"-trimpath",
+		"-buildvcs=false",
+		"-ldflags=-s -w -buildid=",
+		"-o", bootstrap,
+		"main.go")
+	cmd.Dir = filepath.Join(srcs, name)
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+goArch, "CGO_ENABLED=0")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return bootstrap, cmd.Run()
+}
+
+// Zip the bootstrap executable, with fixed metadata
+func packageBootstrap(bootstrap string) ([]byte, error) {
+	bootstrapBytes, err := os.ReadFile(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	header := zip.FileHeader{
+		Name:     BOOTSTRAP,
+		Method:   zip.Deflate,
+		Modified: zipEntryTime,
+	}
+	header.SetMode(0755)
+
+	w, err := zw.CreateHeader(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(bootstrapBytes); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func buildLambda(srcs string, pkgs string, name string, goArch string, failsim bool) error {
+	log.Printf("build lambda %s (%s, tags: %s)\n", name, goArch, getBuildTags(failsim))
+
+	bootstrap, err := compileLambda(srcs, pkgs, name, goArch, failsim)
+	if err != nil {
+		return err
+	}
+
+	zipBytes, err := packageBootstrap(bootstrap)
+	if err != nil {
+		return err
+	}
+
+	zipPath := filepath.Join(pkgs, name, name+"-"+goArch+".zip")
+	if err := os.WriteFile(zipPath, zipBytes, 0644); err != nil {
+		return err
+	}
+
+	codeSha256 := getCodeSha256(zipBytes)
+	if err := os.WriteFile(zipPath+".sha256", []byte(codeSha256+"\n"), 0644); err != nil {
+		return err
+	}
+
+	log.Printf("\tpackage %s of size %d B, sha256: %s\n", zipPath, len(zipBytes), codeSha256)
+
+	return nil
+}
+
+// Lambdas to be built, authorizer included (it is built even if auth is disabled)
+func getBuildLambdaNames(csl string) []string {
+	if csl != "all" {
+		return getLambdaNames(csl)
+	}
+
+	var names []string
+	for _, lmbd := range lambdas {
+		names = append(names, *lmbd.FunctionName)
+	}
+
+	return append(names, *authorizerLambda.FunctionName)
+}
+
+func buildMain(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+
+	csl := fs.String("l", "all",
+		"Comma-separated lambdas to build or all")
+	srcs := fs.String("s", "../../lambdas",
+		"BaseDir for lambda modules sources")
+	pkgs := fs.String("p", "../../lambdas/pkgs",
+		"BaseDir for built lambda deployment packages")
+	goArchs := fs.String("arch", "amd64,arm64",
+		"Comma-separated go archs to build for (amd64 for x86_64, arm64 for Graviton)")
+	noFailsim := fs.Bool("d", false,
+		"Disable failure simulation (build without ENABLE_FAILSIM tag)")
+
+	fs.Parse(args)
+
+	failed := false
+
+	for _, name := range getBuildLambdaNames(*csl) {
+		for _, goArch := range strings.Split(*goArchs, ",") {
+			err := buildLambda(*srcs, *pkgs, name, goArch, !*noFailsim)
+			if err != nil {
+				log.Printf("unable to build lambda %s (%s): %v\n", name, goArch, err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
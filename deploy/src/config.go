@@ -413,11 +413,16 @@ var tables = []dynamodb.CreateTableInput{
 /*
  * Lambda functions to be coordinated via the state machine
  *
- * FunctionName and Timeout may be changed without any kind of issue.
+ * FunctionName, Timeout, MemorySize (MB) and Environment (variables) may be
+ * changed without any kind of issue, e.g.
  *
- * Changing the rest, might result in issues (golang compiler
- * target arch is x86_64, bootstrap is the name of the executable
- * which contains the main() and lambda handler functions)
+ *   Environment: &lmbdtypes.Environment{Variables: map[string]string{"K": "V"}},
+ *
+ * Architectures may be either ArchitectureX8664 or ArchitectureArm64 (Graviton),
+ * a package for that arch must have been built (see ../../lambdas/build-pkg.nix.sh)
+ *
+ * Changing the rest, might result in issues (bootstrap is the name of the
+ * executable which contains the main() and lambda handler functions)
  */
 var lambdas = []lambda.CreateFunctionInput{
 	{
@@ -428,6 +433,7 @@ var lambdas = []lambda.CreateFunctionInput{
 		Runtime:       lmbdtypes.RuntimeProvidedal2023,
 		Handler:       aws.String("bootstrap"),
 		Timeout:       aws.Int32(10),
+		MemorySize:    aws.Int32(128),
 	},
 	{
 		FunctionName:  aws.String("transform"),
@@ -437,6 +443,7 @@ var lambdas = []lambda.CreateFunctionInput{
 		Runtime:       lmbdtypes.RuntimeProvidedal2023,
 		Handler:       aws.String("bootstrap"),
 		Timeout:       aws.Int32(10),
+		MemorySize:    aws.Int32(128),
 	},
 	{
 		FunctionName:  aws.String("store"),
@@ -446,6 +453,7 @@ var lambdas = []lambda.CreateFunctionInput{
 		Runtime:       lmbdtypes.RuntimeProvidedal2023,
 		Handler:       aws.String("bootstrap"),
 		Timeout:       aws.Int32(10),
+		MemorySize:    aws.Int32(128),
 	},
 	{
 		FunctionName:  aws.String("flagValidateFailed"),
@@ -455,6 +463,7 @@ var lambdas = []lambda.CreateFunctionInput{
 		Runtime:       lmbdtypes.RuntimeProvidedal2023,
 		Handler:       aws.String("bootstrap"),
 		Timeout:       aws.Int32(10),
+		MemorySize:    aws.Int32(128),
 	},
 	{
 		FunctionName:  aws.String("flagTransformFailed"),
@@ -464,6 +473,7 @@ var lambdas = []lambda.CreateFunctionInput{
 		Runtime:       lmbdtypes.RuntimeProvidedal2023,
 		Handler:       aws.String("bootstrap"),
 		Timeout:       aws.Int32(10),
+		MemorySize:    aws.Int32(128),
 	},
 	{
 		FunctionName:  aws.String("flagStoreFailed"),
@@ -473,9 +483,43 @@ var lambdas = []lambda.CreateFunctionInput{
 		Runtime:       lmbdtypes.RuntimeProvidedal2023,
 		Handler:       aws.String("bootstrap"),
 		Timeout:       aws.Int32(10),
+		MemorySize:    aws.Int32(128),
+	},
+}
+
+/*
+ * Authorizer lambda, added to lambdas if and only if authentication is
+ * required, same rules as above apply
+ */
+var authorizerLambda = lambda.CreateFunctionInput{
+	FunctionName:  aws.String("authorizer"),
+	Role:          &iamRoleArn,
+	PackageType:   lmbdtypes.PackageTypeZip,
+	Architectures: []lmbdtypes.Architecture{lmbdtypes.ArchitectureX8664},
+	Runtime:       lmbdtypes.RuntimeProvidedal2023,
+	Handler:       aws.String("bootstrap"),
+	Timeout:       aws.Int32(10),
+	MemorySize:    aws.Int32(128),
+	// keys are cached by the lambda, fetched again from the secret this often
+	Environment: &lmbdtypes.Environment{
+		Variables: map[string]string{"SECRET_REFRESH_SECONDS": "300"},
 	},
 }
 
+/*
+ * Reserved concurrency by lambda name, not part of the function definition
+ * (see above). Lambdas not listed here use the unreserved account concurrency.
+ * May be changed without any kind of issue, keep in mind that the account
+ * concurrency limit is shared among all of the lambdas
+ */
+var lambdasReservedConcurrency = map[string]int32{}
+
+/*
+ * Alias of each lambda invoked by the state machine (and the authorizer),
+ * may be changed without any kind of issue before first deployment
+ */
+const LAMBDA_ALIAS = "live"
+
 /*
  * State machine name, may be changed without any kind of issue
  */
@@ -496,8 +540,17 @@ var api = apigatewayv2.CreateApiInput{
 }
 
 /*
+ * State machine input when authentication is required: request body along
+ * with the identity of the client, as returned by the authorizer (context).
+ * Signed requests also carry the body sha256 they were signed with, checked
+ * against the body by the validate lambda (the authorizer never gets it)
  * Do not touch any of the following lines
  */
+const INTEGRATION_INPUT = "$request.body"
+const AUTH_INTEGRATION_INPUT = `{"clientId":"$context.authorizer.clientId","request":$request.body}`
+const HMAC_INTEGRATION_INPUT = `{"clientId":"$context.authorizer.clientId",` +
+	`"contentSha256":"$request.header.X-Content-Sha256","request":$request.body}`
+
 var integration = apigatewayv2.CreateIntegrationInput{
 	Description:          aws.String("CriticalDataPipeline integration"),
 	IntegrationType:      apitypes.IntegrationTypeAwsProxy,
@@ -505,7 +558,7 @@ var integration = apigatewayv2.CreateIntegrationInput{
 	PayloadFormatVersion: aws.String("1.0"),
 	CredentialsArn:       &iamRoleArn,
 	RequestParameters: map[string]string{
-		"Input": "$request.body",
+		"Input": INTEGRATION_INPUT,
 	},
 }
 
@@ -526,6 +579,7 @@ var secret = secretsmanager.CreateSecretInput{
 
 /*
  * Name may be changed, do not change other fields.
+ * AuthorizerResultTtlInSeconds is set by option -auth-ttl
  */
 var authorizer = apigatewayv2.CreateAuthorizerInput{
 	Name:                           aws.String("DataPipelineAuthorizer"),
@@ -536,3 +590,57 @@ var authorizer = apigatewayv2.CreateAuthorizerInput{
 	EnableSimpleResponses:          aws.Bool(true),
 	AuthorizerCredentialsArn:       &iamRoleArn,
 }
+
+/*
+ * Signed requests (option -auth-mode hmac): headers the authorizer requires
+ * and table of the nonces already seen, expired by DynamoDB (TTL) once out
+ * of clock skew (see ../../lambdas/authorizer)
+ * IMPORTANT: table name needs to be changed in the authorizer as well
+ * Do not change the rest
+ */
+var hmacIdentitySource = []string{
+	"$request.header.Authorization",
+	"$request.header.X-Signature-Timestamp",
+	"$request.header.X-Signature-Nonce",
+	"$request.header.X-Content-Sha256",
+}
+
+var nonceTable = dynamodb.CreateTableInput{
+	TableName: aws.String("authNonces"),
+	AttributeDefinitions: []ddbtypes.AttributeDefinition{
+		{
+			AttributeName: aws.String("Nonce"),
+			AttributeType: ddbtypes.ScalarAttributeTypeS,
+		},
+	},
+	KeySchema: []ddbtypes.KeySchemaElement{
+		{
+			AttributeName: aws.String("Nonce"),
+			KeyType:       ddbtypes.KeyTypeHash,
+		},
+	},
+	BillingMode: ddbtypes.BillingModePayPerRequest,
+}
+
+const NONCE_TTL_ATTRIBUTE = "ExpiresAt"
+
+/*
+ * JWT authorizer (option -auth-mode jwt): tokens issued by an OIDC provider
+ * are checked by API Gateway itself, no lambda involved. Issuer and
+ * audience are set by options -jwt-issuer and -jwt-audience
+ * Name and scopes may be changed, do not change the rest
+ */
+var jwtAuthorizer = apigatewayv2.CreateAuthorizerInput{
+	Name:             aws.String("DataPipelineJwtAuthorizer"),
+	AuthorizerType:   apitypes.AuthorizerTypeJwt,
+	IdentitySource:   []string{"$request.header.Authorization"},
+	JwtConfiguration: &apitypes.JWTConfiguration{},
+}
+
+// Scopes required on write (e.g. POST /store) and read (GET) routes
+const JWT_INGEST_SCOPE = "pipeline:ingest"
+const JWT_READ_SCOPE = "pipeline:read"
+
+// Token claim recorded as client identity on each tuple's status rows
+// (client_credentials tokens carry the client id as subject)
+const JWT_INTEGRATION_INPUT = `{"clientId":"$context.authorizer.claims.sub","request":$request.body}`
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * Selective teardown (subcommand destroy)
+ *
+ * Unlike -d, which deletes everything, only some components may be deleted
+ * (--only) or kept (--keep). Components are:
+ *
+ *  - api: api, routes and integrations (authorizer included)
+ *  - authorizer: authorizer (detached from the route), its lambda and the
+ *    nonce table of signed requests
+ *  - tables: status tables
+ *  - lambdas: pipeline lambdas
+ *  - stateMachine
+ *  - roles: least-privilege roles (option -r), only if explicitly listed
+ *  - secret: authorizer secret, only if explicitly listed
+ *  - data: final data table, protected: deleted only if listed in --only,
+ *          along with --include-data
+ */
+
+const (
+	COMPONENT_API           = "api"
+	COMPONENT_AUTHORIZER    = "authorizer"
+	COMPONENT_TABLES        = "tables"
+	COMPONENT_LAMBDAS       = "lambdas"
+	COMPONENT_STATE_MACHINE = "stateMachine"
+	COMPONENT_ROLES         = "roles"
+	COMPONENT_SECRET        = "secret"
+	COMPONENT_DATA          = "data"
+)
+
+// Components deleted by destroy when --only is not given
+var defaultComponents = []string{
+	COMPONENT_API,
+	COMPONENT_AUTHORIZER,
+	COMPONENT_TABLES,
+	COMPONENT_LAMBDAS,
+	COMPONENT_STATE_MACHINE,
+}
+
+var allComponents = []string{
+	COMPONENT_API,
+	COMPONENT_AUTHORIZER,
+	COMPONENT_TABLES,
+	COMPONENT_LAMBDAS,
+	COMPONENT_STATE_MACHINE,
+	COMPONENT_ROLES,
+	COMPONENT_SECRET,
+	COMPONENT_DATA,
+}
+
+func getDataTable() *string {
+	return tables[3].TableName //nycYellowTaxis
+}
+
+// Components deleted by -d (data table included, as it has always been)
+func getDeleteAllComponents(cmdline *Cmdline) map[string]bool {
+	components := map[string]bool{COMPONENT_DATA: true}
+	for _, component := range defaultComponents {
+		components[component] = true
+	}
+
+	components[COMPONENT_ROLES] = cmdline.leastPrivilege
+	components[COMPONENT_SECRET] = cmdline.forceSecretDel
+
+	return components
+}
+
+func parseComponents(csl string) []string {
+	var components []string
+
+	for _, component := range strings.Split(csl, ",") {
+		component = strings.TrimSpace(component)
+		if len(component) == 0 {
+			continue
+		}
+
+		known := false
+		for _, other := range allComponents {
+			if component == other {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			log.Fatalf("unknown component %s (expected one of: %s)",
+				component, strings.Join(allComponents, ", "))
+		}
+
+		components = append(components, component)
+	}
+
+	return components
+}
+
+func getDestroyComponents(only string, keep string, includeData bool) map[string]bool {
+	components := make(map[string]bool)
+
+	selected := defaultComponents
+	if len(only) > 0 {
+		selected = parseComponents(only)
+	}
+	for _, component := range selected {
+		components[component] = true
+	}
+
+	if components[COMPONENT_DATA] && !includeData {
+		log.Fatalf("table %s is protected, add --include-data to delete it", *getDataTable())
+	}
+	for _, component := range parseComponents(keep) {
+		delete(components, component)
+	}
+
+	return components
+}
+
+func destroyMain(args []string) {
+	fs := flag.NewFlagSet("destroy", flag.ExitOnError)
+
+	only := fs.String("only", "",
+		"Comma-separated components to delete (default: "+
+			strings.Join(defaultComponents, ",")+"), among: "+strings.Join(allComponents, ","))
+	keep := fs.String("keep", "",
+		"Comma-separated components not to delete")
+	includeData := fs.Bool("include-data", false,
+		"Allow deleting the final data table "+*getDataTable()+" (data, to be listed in --only)")
+	waitTimeout := fs.Duration("w", 5*time.Minute,
+		"Max time to wait for each resource to be deleted. 0 to not wait at all")
+	maxParallelSteps := fs.Int("j", 4,
+		"Max number of independent steps to run concurrently")
+
+	fs.Parse(args)
+
+	components := getDestroyComponents(*only, *keep, *includeData)
+	if len(components) == 0 {
+		log.Println("nothing to destroy")
+		return
+	}
+
+	var names []string
+	for _, component := range allComponents {
+		if components[component] {
+			names = append(names, component)
+		}
+	}
+	log.Printf("destroy %s\n", strings.Join(names, ", "))
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	steps := getTeardownSteps(components, *waitTimeout)
+
+	intChan := beginIgnoreInterruption()
+	ok := runSteps(steps, *maxParallelSteps)
+	endIgnoreInteruption(intChan)
+
+	if !ok {
+		os.Exit(1)
+	}
+}
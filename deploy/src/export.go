@@ -0,0 +1,576 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	lmbdtypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+/*
+ * Export deployment as IaC template
+ *
+ * Instead of creating resources via the AWS SDK, emit a template describing
+ * the very same resources (see config.go), so that environments allowing
+ * only IaC-managed resources can deploy the pipeline by their own tools
+ *
+ *  - cfn: AWS CloudFormation template (JSON), lambda packages are expected
+ *         to be uploaded to an S3 bucket (template parameter ArtifactsBucket)
+ *         with the same pkgs/ layout (<name>/<name>-<arch>.zip)
+ *  - sam: AWS SAM template (JSON), lambda packages are referenced by local path
+ *         (sam deploy takes care of uploading them)
+ *  - terraform: Terraform JSON configuration (save it as *.tf.json), lambda
+ *         packages are referenced by local path
+ *
+ * Authentication key is never written in the template, it is a (sensitive)
+ * template parameter/variable instead. Only auth mode key can be exported:
+ * signed requests need the hashes of a key registry in the secret, along with
+ * the nonce table, and jwt per-route scopes, so export fails with any other
+ * mode rather than emitting a different pipeline. Point-in-time recovery
+ * (-pitr) is a table property in both CloudFormation and Terraform
+ */
+
+type Tmpl map[string]interface{}
+
+var exportFormats = []string{"cfn", "sam", "terraform"}
+
+// CloudFormation logical ids must be alphanumeric
+func logicalId(name string, kind string) string {
+	return strings.ToUpper(name[:1]) + name[1:] + kind
+}
+
+func cfnRef(logicalId string) Tmpl {
+	return Tmpl{"Ref": logicalId}
+}
+
+func cfnGetAtt(logicalId string, attr string) Tmpl {
+	return Tmpl{"Fn::GetAtt": []string{logicalId, attr}}
+}
+
+func cfnSub(str string) Tmpl {
+	return Tmpl{"Fn::Sub": str}
+}
+
+func lambdaArchitectures(idx int) []string {
+	var archs []string
+	for _, arch := range lambdas[idx].Architectures {
+		archs = append(archs, string(arch))
+	}
+
+	return archs
+}
+
+// Relative to pkgs/ (and to ArtifactsBucket)
+func lambdaS3Key(name string, archs []lmbdtypes.Architecture) string {
+	return name + "/" + name + "-" + getGoArch(archs) + ".zip"
+}
+
+func lambdaPkgPath(pkgs string, name string, archs []lmbdtypes.Architecture) string {
+	return pkgs + "/" + lambdaS3Key(name, archs)
+}
+
+// Both CloudFormation and SAM templates share everything but lambdas
+func getCfnTemplate(sam bool, authRequired bool, pitr bool, pkgs string) Tmpl {
+	roleArn := cfnSub("arn:aws:iam::${AWS::AccountId}:role/${RoleName}")
+
+	params := Tmpl{
+		"RoleName": Tmpl{
+			"Type":        "String",
+			"Default":     IAM_ROLE,
+			"Description": "Pre-existing IAM role used by lambdas, state machine and api",
+		},
+	}
+
+	resources := Tmpl{}
+
+	for _, table := range tables {
+		var attrs []Tmpl
+		for _, attr := range table.AttributeDefinitions {
+			attrs = append(attrs, Tmpl{
+				"AttributeName": *attr.AttributeName,
+				"AttributeType": string(attr.AttributeType),
+			})
+		}
+
+		var keys []Tmpl
+		for _, key := range table.KeySchema {
+			keys = append(keys, Tmpl{
+				"AttributeName": *key.AttributeName,
+				"KeyType":       string(key.KeyType),
+			})
+		}
+
+		props := Tmpl{
+			"TableName":            *table.TableName,
+			"AttributeDefinitions": attrs,
+			"KeySchema":            keys,
+			"BillingMode":          string(table.BillingMode),
+		}
+		if pitr {
+			props["PointInTimeRecoverySpecification"] = Tmpl{"PointInTimeRecoveryEnabled": true}
+		}
+
+		resources[logicalId(*table.TableName, "Table")] = Tmpl{
+			"Type":       "AWS::DynamoDB::Table",
+			"Properties": props,
+		}
+	}
+
+	if !sam {
+		params["ArtifactsBucket"] = Tmpl{
+			"Type":        "String",
+			"Description": "S3 bucket containing lambda deployment packages (<name>/<name>-<goarch>.zip)",
+		}
+	}
+
+	var aliasIds []string
+
+	for idx, lmbd := range lambdas {
+		name := *lmbd.FunctionName
+
+		props := Tmpl{
+			"FunctionName":  name,
+			"Role":          roleArn,
+			"PackageType":   string(lmbd.PackageType),
+			"Architectures": lambdaArchitectures(idx),
+			"Runtime":       string(lmbd.Runtime),
+			"Handler":       *lmbd.Handler,
+			"Timeout":       *lmbd.Timeout,
+			"MemorySize":    *lmbd.MemorySize,
+		}
+		if lmbd.Environment != nil {
+			props["Environment"] = Tmpl{"Variables": lmbd.Environment.Variables}
+		}
+		if concurrency, ok := lambdasReservedConcurrency[name]; ok {
+			props["ReservedConcurrentExecutions"] = concurrency
+		}
+
+		id := logicalId(name, "Function")
+
+		// lambdas are invoked by their alias (see versions.go)
+		resType := "AWS::Lambda::Function"
+		if sam {
+			resType = "AWS::Serverless::Function"
+			props["CodeUri"] = lambdaPkgPath(pkgs, name, lmbd.Architectures)
+			props["AutoPublishAlias"] = LAMBDA_ALIAS
+			aliasIds = append(aliasIds, id+"Alias"+LAMBDA_ALIAS)
+		} else {
+			props["Code"] = Tmpl{
+				"S3Bucket": cfnRef("ArtifactsBucket"),
+				"S3Key":    lambdaS3Key(name, lmbd.Architectures),
+			}
+
+			resources[id+"Version"] = Tmpl{
+				"Type":       "AWS::Lambda::Version",
+				"Properties": Tmpl{"FunctionName": cfnRef(id)},
+			}
+
+			resources[id+"Alias"] = Tmpl{
+				"Type": "AWS::Lambda::Alias",
+				"Properties": Tmpl{
+					"FunctionName":    cfnRef(id),
+					"FunctionVersion": cfnGetAtt(id+"Version", "Version"),
+					"Name":            LAMBDA_ALIAS,
+				},
+			}
+
+			aliasIds = append(aliasIds, id+"Alias")
+		}
+
+		resources[id] = Tmpl{
+			"Type":       resType,
+			"Properties": props,
+		}
+	}
+
+	resources["StateMachine"] = Tmpl{
+		"Type":      "AWS::StepFunctions::StateMachine",
+		"DependsOn": aliasIds,
+		"Properties": Tmpl{
+			"StateMachineName": *stateMachine.Name,
+			"RoleArn":          roleArn,
+			"DefinitionString": getStateMachineDefinition(),
+		},
+	}
+
+	resources["Api"] = Tmpl{
+		"Type": "AWS::ApiGatewayV2::Api",
+		"Properties": Tmpl{
+			"Name":         *api.Name,
+			"ProtocolType": string(api.ProtocolType),
+		},
+	}
+
+	integReqParams := Tmpl{"StateMachineArn": cfnRef("StateMachine")}
+	for k, v := range integration.RequestParameters {
+		integReqParams[k] = v
+	}
+
+	resources["Integration"] = Tmpl{
+		"Type": "AWS::ApiGatewayV2::Integration",
+		"Properties": Tmpl{
+			"ApiId":                cfnRef("Api"),
+			"Description":          *integration.Description,
+			"IntegrationType":      string(integration.IntegrationType),
+			"IntegrationSubtype":   *integration.IntegrationSubtype,
+			"PayloadFormatVersion": *integration.PayloadFormatVersion,
+			"CredentialsArn":       roleArn,
+			"RequestParameters":    integReqParams,
+		},
+	}
+
+	routeProps := Tmpl{
+		"ApiId":    cfnRef("Api"),
+		"RouteKey": *route.RouteKey,
+		"Target":   cfnSub("integrations/${Integration}"),
+	}
+
+	resources["Route"] = Tmpl{
+		"Type":       "AWS::ApiGatewayV2::Route",
+		"Properties": routeProps,
+	}
+
+	resources["Stage"] = Tmpl{
+		"Type": "AWS::ApiGatewayV2::Stage",
+		"Properties": Tmpl{
+			"ApiId":      cfnRef("Api"),
+			"StageName":  "$default",
+			"AutoDeploy": true,
+		},
+	}
+
+	if authRequired {
+		params["AuthKey"] = Tmpl{
+			"Type":        "String",
+			"NoEcho":      true,
+			"Description": "Key to be entered on \"Authorization\" http header when making requests",
+		}
+
+		// CloudFormation does not support binary secrets, the authorizer
+		// lambda falls back to the secret string
+		resources["Secret"] = Tmpl{
+			"Type": "AWS::SecretsManager::Secret",
+			"Properties": Tmpl{
+				"Name":         *secret.Name,
+				"Description":  *secret.Description,
+				"SecretString": cfnRef("AuthKey"),
+			},
+		}
+
+		// Ref to an alias is its ARN
+		authorizerAliasId := aliasIds[len(aliasIds)-1]
+
+		resources["Authorizer"] = Tmpl{
+			"Type":      "AWS::ApiGatewayV2::Authorizer",
+			"DependsOn": []string{"Secret"},
+			"Properties": Tmpl{
+				"ApiId":                          cfnRef("Api"),
+				"Name":                           *authorizer.Name,
+				"AuthorizerType":                 string(authorizer.AuthorizerType),
+				"IdentitySource":                 authorizer.IdentitySource,
+				"AuthorizerPayloadFormatVersion": *authorizer.AuthorizerPayloadFormatVersion,
+				"AuthorizerResultTtlInSeconds":   *authorizer.AuthorizerResultTtlInSeconds,
+				"EnableSimpleResponses":          *authorizer.EnableSimpleResponses,
+				"AuthorizerCredentialsArn":       roleArn,
+				"AuthorizerUri": cfnSub("arn:aws:apigateway:${AWS::Region}:lambda:path/" +
+					"2015-03-31/functions/${" + authorizerAliasId + "}/invocations"),
+			},
+		}
+
+		routeProps["AuthorizationType"] = "CUSTOM"
+		routeProps["AuthorizerId"] = cfnRef("Authorizer")
+	}
+
+	tmpl := Tmpl{
+		"AWSTemplateFormatVersion": "2010-09-09",
+		"Description":              "serverless data pipeline (" + *stateMachine.Name + ")",
+		"Parameters":               params,
+		"Resources":                resources,
+		"Outputs": Tmpl{
+			"ApiEndpoint": Tmpl{"Value": cfnGetAtt("Api", "ApiEndpoint")},
+		},
+	}
+
+	if sam {
+		tmpl["Transform"] = "AWS::Serverless-2016-10-31"
+	}
+
+	return tmpl
+}
+
+func getTerraformTemplate(authRequired bool, pitr bool, pkgs string) Tmpl {
+	roleArn := "${data.aws_iam_role.pipeline.arn}"
+
+	variables := Tmpl{
+		"pkgs_dir": Tmpl{
+			"type":        "string",
+			"default":     pkgs,
+			"description": "BaseDir for built lambda deployment packages",
+		},
+		"iam_role_name": Tmpl{
+			"type":        "string",
+			"default":     IAM_ROLE,
+			"description": "Pre-existing IAM role used by lambdas, state machine and api",
+		},
+	}
+
+	dynamodbTables := Tmpl{}
+	for _, table := range tables {
+		var attrs []Tmpl
+		for _, attr := range table.AttributeDefinitions {
+			attrs = append(attrs, Tmpl{
+				"name": *attr.AttributeName,
+				"type": string(attr.AttributeType),
+			})
+		}
+
+		res := Tmpl{
+			"name":         *table.TableName,
+			"billing_mode": string(table.BillingMode),
+			"attribute":    attrs,
+		}
+
+		for _, key := range table.KeySchema {
+			if key.KeyType == ddbtypes.KeyTypeHash {
+				res["hash_key"] = *key.AttributeName
+			} else {
+				res["range_key"] = *key.AttributeName
+			}
+		}
+
+		if pitr {
+			res["point_in_time_recovery"] = []Tmpl{{"enabled": true}}
+		}
+
+		dynamodbTables[*table.TableName] = res
+	}
+
+	lambdaFunctions := Tmpl{}
+	lambdaAliases := Tmpl{}
+	var aliasRefs []string
+
+	for idx, lmbd := range lambdas {
+		name := *lmbd.FunctionName
+		pkgPath := lambdaPkgPath("${var.pkgs_dir}", name, lmbd.Architectures)
+
+		res := Tmpl{
+			"function_name":    name,
+			"role":             roleArn,
+			"package_type":     string(lmbd.PackageType),
+			"architectures":    lambdaArchitectures(idx),
+			"runtime":          string(lmbd.Runtime),
+			"handler":          *lmbd.Handler,
+			"timeout":          *lmbd.Timeout,
+			"filename":         pkgPath,
+			"source_code_hash": "${filebase64sha256(\"" + pkgPath + "\")}",
+			"memory_size":      *lmbd.MemorySize,
+			"publish":          true,
+		}
+		if lmbd.Environment != nil {
+			res["environment"] = Tmpl{"variables": lmbd.Environment.Variables}
+		}
+		if concurrency, ok := lambdasReservedConcurrency[name]; ok {
+			res["reserved_concurrent_executions"] = concurrency
+		}
+
+		lambdaFunctions[name] = res
+
+		// lambdas are invoked by their alias (see versions.go)
+		lambdaAliases[name] = Tmpl{
+			"name":             LAMBDA_ALIAS,
+			"function_name":    "${aws_lambda_function." + name + ".function_name}",
+			"function_version": "${aws_lambda_function." + name + ".version}",
+		}
+
+		aliasRefs = append(aliasRefs, "aws_lambda_alias."+name)
+	}
+
+	integReqParams := Tmpl{"StateMachineArn": "${aws_sfn_state_machine.pipeline.arn}"}
+	for k, v := range integration.RequestParameters {
+		integReqParams[k] = v
+	}
+
+	routeRes := Tmpl{
+		"api_id":    "${aws_apigatewayv2_api.pipeline.id}",
+		"route_key": *route.RouteKey,
+		"target":    "integrations/${aws_apigatewayv2_integration.pipeline.id}",
+	}
+
+	resources := Tmpl{
+		"aws_dynamodb_table":  dynamodbTables,
+		"aws_lambda_function": lambdaFunctions,
+		"aws_lambda_alias":    lambdaAliases,
+		"aws_sfn_state_machine": Tmpl{
+			"pipeline": Tmpl{
+				"name":       *stateMachine.Name,
+				"role_arn":   roleArn,
+				"definition": getStateMachineDefinition(),
+				"depends_on": aliasRefs,
+			},
+		},
+		"aws_apigatewayv2_api": Tmpl{
+			"pipeline": Tmpl{
+				"name":          *api.Name,
+				"protocol_type": string(api.ProtocolType),
+			},
+		},
+		"aws_apigatewayv2_integration": Tmpl{
+			"pipeline": Tmpl{
+				"api_id":                 "${aws_apigatewayv2_api.pipeline.id}",
+				"description":            *integration.Description,
+				"integration_type":       string(integration.IntegrationType),
+				"integration_subtype":    *integration.IntegrationSubtype,
+				"payload_format_version": *integration.PayloadFormatVersion,
+				"credentials_arn":        roleArn,
+				"request_parameters":     integReqParams,
+			},
+		},
+		"aws_apigatewayv2_route": Tmpl{"pipeline": routeRes},
+		"aws_apigatewayv2_stage": Tmpl{
+			"pipeline": Tmpl{
+				"api_id":      "${aws_apigatewayv2_api.pipeline.id}",
+				"name":        "$default",
+				"auto_deploy": true,
+			},
+		},
+	}
+
+	if authRequired {
+		variables["auth_key"] = Tmpl{
+			"type":        "string",
+			"sensitive":   true,
+			"description": "Key to be entered on \"Authorization\" http header when making requests",
+		}
+
+		authorizerName := *lambdas[len(lambdas)-1].FunctionName
+
+		resources["aws_secretsmanager_secret"] = Tmpl{
+			"pipeline": Tmpl{
+				"name":        *secret.Name,
+				"description": *secret.Description,
+			},
+		}
+
+		resources["aws_secretsmanager_secret_version"] = Tmpl{
+			"pipeline": Tmpl{
+				"secret_id":     "${aws_secretsmanager_secret.pipeline.id}",
+				"secret_binary": "${base64encode(var.auth_key)}",
+			},
+		}
+
+		resources["aws_apigatewayv2_authorizer"] = Tmpl{
+			"pipeline": Tmpl{
+				"api_id":                            "${aws_apigatewayv2_api.pipeline.id}",
+				"name":                              *authorizer.Name,
+				"authorizer_type":                   string(authorizer.AuthorizerType),
+				"identity_sources":                  authorizer.IdentitySource,
+				"authorizer_payload_format_version": *authorizer.AuthorizerPayloadFormatVersion,
+				"authorizer_result_ttl_in_seconds":  *authorizer.AuthorizerResultTtlInSeconds,
+				"enable_simple_responses":           *authorizer.EnableSimpleResponses,
+				"authorizer_credentials_arn":        roleArn,
+				"authorizer_uri":                    "${aws_lambda_alias." + authorizerName + ".invoke_arn}",
+				"depends_on":                        []string{"aws_secretsmanager_secret_version.pipeline"},
+			},
+		}
+
+		routeRes["authorization_type"] = "CUSTOM"
+		routeRes["authorizer_id"] = "${aws_apigatewayv2_authorizer.pipeline.id}"
+	}
+
+	return Tmpl{
+		"terraform": Tmpl{
+			"required_providers": Tmpl{
+				"aws": Tmpl{"source": "hashicorp/aws"},
+			},
+		},
+		"provider": Tmpl{
+			"aws": Tmpl{"region": AWS_REGION},
+		},
+		"variable": variables,
+		"data": Tmpl{
+			"aws_iam_role": Tmpl{
+				"pipeline": Tmpl{"name": "${var.iam_role_name}"},
+			},
+		},
+		"resource": resources,
+		"output": Tmpl{
+			"api_endpoint": Tmpl{"value": "${aws_apigatewayv2_api.pipeline.api_endpoint}"},
+		},
+	}
+}
+
+func exportTemplate(format string, authRequired bool, authMode string, pitr bool,
+	pkgs string) (Tmpl, error) {
+	if authMode != AUTH_MODE_KEY {
+		return nil, fmt.Errorf("auth mode %s cannot be exported (only %s), deploy it with -auth-mode instead",
+			authMode, AUTH_MODE_KEY)
+	}
+
+	if authRequired {
+		addAuthorizerLambda()
+	}
+
+	switch format {
+	case "cfn":
+		return getCfnTemplate(false, authRequired, pitr, pkgs), nil
+	case "sam":
+		return getCfnTemplate(true, authRequired, pitr, pkgs), nil
+	case "terraform":
+		return getTerraformTemplate(authRequired, pitr, pkgs), nil
+	}
+
+	return nil, fmt.Errorf("unknown format %s (available: %s)",
+		format, strings.Join(exportFormats, ", "))
+}
+
+// deploy export [options]
+func exportMain(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+
+	format := fs.String("format", "cfn",
+		"Template format: "+strings.Join(exportFormats, ", "))
+	authRequired := fs.Bool("a", false,
+		"Include authorizer, its lambda and secret (key is a template parameter)")
+	authTtl := fs.Int("auth-ttl", 0,
+		"Along with -a, seconds API Gateway caches authorization results for (0: no caching)")
+	authMode := fs.String("auth-mode", AUTH_MODE_KEY,
+		"How producers authenticate, only "+AUTH_MODE_KEY+" can be exported ("+AUTH_MODE_HMAC+
+			" and "+AUTH_MODE_JWT+" fail)")
+	pitr := fs.Bool("pitr", false, "Enable point-in-time recovery on tables, as deploy -pitr does")
+	pkgs := fs.String("p", "../../lambdas/pkgs",
+		"BaseDir for built lambda deployment packages (sam and terraform only)")
+	output := fs.String("o", "",
+		"Write template to file instead of stdout")
+
+	fs.Parse(args)
+
+	setAuthorizerTtl(*authTtl)
+
+	tmpl, err := exportTemplate(*format, *authRequired, *authMode, *pitr, *pkgs)
+	if err != nil {
+		log.Fatalf("unable to export: %v", err)
+	}
+
+	tmplBytes, err := json.MarshalIndent(tmpl, "", "  ")
+	if err != nil {
+		log.Fatalf("unable to marshal template: %v", err)
+	}
+
+	tmplBytes = append(tmplBytes, '\n')
+
+	if len(*output) == 0 {
+		os.Stdout.Write(tmplBytes)
+		return
+	}
+
+	if err := os.WriteFile(*output, tmplBytes, 0644); err != nil {
+		log.Fatalf("unable to write template: %v", err)
+	}
+
+	log.Printf("export %s template to %s\n", *format, *output)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+/*
+ * Least-privilege IAM roles (option -r)
+ *
+ * By default everything runs under the single pre-existing IAM_ROLE. If
+ * requested, a dedicated role (with an inline policy) is created for each
+ * lambda, for the state machine and for the API (integration and authorizer
+ * credentials), allowing only what is strictly needed:
+ *
+ *  - validate, transform: put items in their own status table
+ *  - store: put items in its own status table and in the final table
+ *  - flag*Failed: update items in the status table they flag
+ *  - authorizer: read its own secret, record nonces of signed requests
+ *  - state machine: invoke the pipeline lambdas
+ *  - api: start state machine executions, invoke the authorizer
+ *
+ * Lambdas are also allowed to write their own CloudWatch logs.
+ *
+ * If a role cannot be created (e.g. IAM_ROLE is the only role the account
+ * may use, as it happens with AWS academy), the shared role is used instead
+ */
+
+const ROLE_NAME_PREFIX = "DataPipeline-"
+const ROLE_POLICY_NAME = "DataPipelineLeastPrivilege"
+
+// Newly created roles take a while before they can be assumed by AWS services
+const IAM_PROPAGATION_DELAY = 10 * time.Second
+
+type PolicyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+type PolicyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+type RoleSpec struct {
+	name       string // lambda, state machine or api name the role is created for
+	principal  string // AWS service allowed to assume the role
+	statements []PolicyStatement
+}
+
+// Dedicated roles ARNs by resource name, written by createRoles only
+var roleArns = map[string]string{}
+var roleArnsLock sync.Mutex
+
+// Role to be used for a given resource (falls back to shared IAM_ROLE)
+func getRoleArn(name string) *string {
+	roleArnsLock.Lock()
+	defer roleArnsLock.Unlock()
+
+	if arn, ok := roleArns[name]; ok {
+		return &arn
+	}
+
+	return &iamRoleArn
+}
+
+func allow(actions []string, resources ...string) PolicyStatement {
+	return PolicyStatement{Effect: "Allow", Action: actions, Resource: resources}
+}
+
+// ARNs are built from region and account id of the shared role
+func getArnBuilder() func(string) string {
+	account := ""
+	if fields := strings.Split(iamRoleArn, ":"); len(fields) > 4 {
+		account = fields[4]
+	}
+
+	return strings.NewReplacer("{region}", AWS_REGION, "{account}", account).Replace
+}
+
+func getRoleSpecs() []RoleSpec {
+	arn := getArnBuilder()
+
+	tableArn := func(idx int) string {
+		return arn("arn:aws:dynamodb:{region}:{account}:table/" + *tables[idx].TableName)
+	}
+
+	functionArn := func(name *string) string {
+		return arn("arn:aws:lambda:{region}:{account}:function:" + *name)
+	}
+
+	logs := allow(
+		[]string{"logs:CreateLogGroup", "logs:CreateLogStream", "logs:PutLogEvents"},
+		arn("arn:aws:logs:{region}:{account}:*"))
+
+	putItem := []string{"dynamodb:PutItem"}
+	updateItem := []string{"dynamodb:UpdateItem"}
+
+	specs := []RoleSpec{
+		{
+			name:       *lambdas[0].FunctionName, //validate
+			principal:  "lambda.amazonaws.com",
+			statements: []PolicyStatement{logs, allow(putItem, tableArn(0))}, //validationStatus
+		},
+		{
+			name:       *lambdas[1].FunctionName, //transform
+			principal:  "lambda.amazonaws.com",
+			statements: []PolicyStatement{logs, allow(putItem, tableArn(1))}, //transformationStatus
+		},
+		{
+			name:      *lambdas[2].FunctionName, //store
+			principal: "lambda.amazonaws.com",
+			statements: []PolicyStatement{logs,
+				allow(putItem, tableArn(2), tableArn(3))}, //storeStatus, nycYellowTaxis
+		},
+		{
+			name:       *lambdas[3].FunctionName, //flagValidateFailed
+			principal:  "lambda.amazonaws.com",
+			statements: []PolicyStatement{logs, allow(updateItem, tableArn(0))}, //validationStatus
+		},
+		{
+			name:       *lambdas[4].FunctionName, //flagTransformFailed
+			principal:  "lambda.amazonaws.com",
+			statements: []PolicyStatement{logs, allow(updateItem, tableArn(1))}, //transformationStatus
+		},
+		{
+			name:       *lambdas[5].FunctionName, //flagStoreFailed
+			principal:  "lambda.amazonaws.com",
+			statements: []PolicyStatement{logs, allow(updateItem, tableArn(2))}, //storeStatus
+		},
+	}
+
+	var pipelineFunctions []string
+	for _, lmbd := range lambdas[:6] {
+		pipelineFunctions = append(pipelineFunctions,
+			functionArn(lmbd.FunctionName), functionArn(lmbd.FunctionName)+":*")
+	}
+
+	specs = append(specs, RoleSpec{
+		name:      *stateMachine.Name,
+		principal: "states.amazonaws.com",
+		statements: []PolicyStatement{
+			allow([]string{"lambda:InvokeFunction"}, pipelineFunctions...),
+		},
+	})
+
+	authorizerFunction := functionArn(aws.String("authorizer"))
+
+	specs = append(specs,
+		RoleSpec{
+			name:      "authorizer",
+			principal: "lambda.amazonaws.com",
+			statements: []PolicyStatement{
+				logs,
+				// secret ARN ends with a random suffix
+				allow([]string{"secretsmanager:GetSecretValue"},
+					arn("arn:aws:secretsmanager:{region}:{account}:secret:"+*secret.Name+"-*")),
+				// ListSecrets does not support resource-level permissions
+				allow([]string{"secretsmanager:ListSecrets"}, "*"),
+				allow(putItem, arn("arn:aws:dynamodb:{region}:{account}:table/"+*nonceTable.TableName)),
+			},
+		},
+		RoleSpec{
+			name:      *api.Name,
+			principal: "apigateway.amazonaws.com",
+			statements: []PolicyStatement{
+				allow([]string{"states:StartExecution"},
+					arn("arn:aws:states:{region}:{account}:stateMachine:"+*stateMachine.Name)),
+				allow([]string{"lambda:InvokeFunction"},
+					authorizerFunction, authorizerFunction+":*"),
+			},
+		})
+
+	return specs
+}
+
+func getAssumeRolePolicy(principal string) (string, error) {
+	doc := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect":    "Allow",
+				"Principal": map[string]string{"Service": principal},
+				"Action":    "sts:AssumeRole",
+			},
+		},
+	}
+
+	docBytes, err := json.Marshal(doc)
+	return string(docBytes), err
+}
+
+// Create (or reuse) a role and put its inline policy, returns role ARN and
+// whether the role was just created
+func createOrUpdateRole(spec *RoleSpec) (*string, bool, error) {
+	roleName := aws.String(ROLE_NAME_PREFIX + spec.name)
+	created := true
+
+	assumeRolePolicy, err := getAssumeRolePolicy(spec.principal)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var roleArn *string
+
+	cri := iam.CreateRoleInput{
+		RoleName:                 roleName,
+		AssumeRolePolicyDocument: &assumeRolePolicy,
+		Description:              aws.String("data pipeline least-privilege role for " + spec.name),
+	}
+	crOut, err := svc.iam.CreateRole(dflCtx(), &cri)
+	if err != nil {
+		var alreadyExists *iamtypes.EntityAlreadyExistsException
+		if !errors.As(err, &alreadyExists) {
+			return nil, false, err
+		}
+
+		grOut, err := svc.iam.GetRole(dflCtx(), &iam.GetRoleInput{RoleName: roleName})
+		if err != nil {
+			return nil, false, err
+		}
+
+		roleArn = grOut.Role.Arn
+		created = false
+	} else {
+		roleArn = crOut.Role.Arn
+	}
+
+	policyBytes, err := json.Marshal(PolicyDocument{
+		Version:   "2012-10-17",
+		Statement: spec.statements,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	prpi := iam.PutRolePolicyInput{
+		RoleName:       roleName,
+		PolicyName:     aws.String(ROLE_POLICY_NAME),
+		PolicyDocument: aws.String(string(policyBytes)),
+	}
+	if _, err := svc.iam.PutRolePolicy(dflCtx(), &prpi); err != nil {
+		return nil, false, err
+	}
+
+	return roleArn, created, nil
+}
+
+// Create dedicated roles, if requested
+func createRoles(leastPrivilege bool) {
+	if !leastPrivilege {
+		log.Printf("using shared role %s for all resources\n", IAM_ROLE)
+		return
+	}
+
+	anyCreated := false
+
+	for _, spec := range getRoleSpecs() {
+		roleArn, created, err := createOrUpdateRole(&spec)
+		if err != nil {
+			log.Printf("unable to create role for %s (falling back to shared role %s): %v\n",
+				spec.name, IAM_ROLE, err)
+			continue
+		}
+
+		roleArnsLock.Lock()
+		roleArns[spec.name] = *roleArn
+		roleArnsLock.Unlock()
+
+		head := "update"
+		if created {
+			head = "create"
+			anyCreated = true
+		}
+
+		log.Printf("%s role %s%s, arn: %s, for: %s\n",
+			head, ROLE_NAME_PREFIX, spec.name, *roleArn, spec.name)
+	}
+
+	if anyCreated {
+		log.Printf("waiting %v for new roles to propagate\n", IAM_PROPAGATION_DELAY)
+		time.Sleep(IAM_PROPAGATION_DELAY)
+	}
+}
+
+// Delete dedicated roles: if they were never created
+// deletion will fail, program just goes on...
+func deleteRoles() {
+	for _, spec := range getRoleSpecs() {
+		roleName := aws.String(ROLE_NAME_PREFIX + spec.name)
+
+		drpi := iam.DeleteRolePolicyInput{
+			RoleName:   roleName,
+			PolicyName: aws.String(ROLE_POLICY_NAME),
+		}
+		if _, err := svc.iam.DeleteRolePolicy(dflCtx(), &drpi); err != nil {
+			log.Printf("unable to delete role policy %s: %v\n", *roleName, err)
+			continue
+		}
+
+		dri := iam.DeleteRoleInput{RoleName: roleName}
+		if _, err := svc.iam.DeleteRole(dflCtx(), &dri); err != nil {
+			log.Printf("unable to delete role %s: %v\n", *roleName, err)
+		} else {
+			log.Printf("delete role %s\n", *roleName)
+		}
+	}
+}
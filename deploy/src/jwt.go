@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewayv2"
+	apigtypes "github.com/aws/aws-sdk-go-v2/service/apigatewayv2/types"
+)
+
+/*
+ * JWT authorization (auth mode jwt)
+ *
+ * Producers get an access token from an OIDC provider (client credentials)
+ * and send it as "Authorization: Bearer <token>". API Gateway checks
+ * issuer, audience and expiration of the token, and that it carries the
+ * scopes required by the route: JWT_INGEST_SCOPE on POST /store (and any
+ * other write route), JWT_READ_SCOPE on GET routes. Neither the secret nor
+ * the authorizer lambda are involved
+ */
+
+const AUTH_MODE_JWT = "jwt"
+
+var jwtIngestScopes = []string{JWT_INGEST_SCOPE}
+var jwtReadScopes = []string{JWT_READ_SCOPE}
+
+func splitList(csl string) []string {
+	var items []string
+	for _, item := range strings.Split(csl, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func setJwtConfig(issuer string, audience string, ingestScopes string, readScopes string) {
+	issuerUrl, err := url.Parse(issuer)
+	if err != nil || issuerUrl.Scheme != "https" || len(issuerUrl.Host) == 0 {
+		log.Fatalf("jwt issuer must be an https url, got %q", issuer)
+	}
+
+	audiences := splitList(audience)
+	if len(audiences) == 0 {
+		log.Fatalln("jwt audience is required")
+	}
+
+	jwtAuthorizer.JwtConfiguration.Issuer = aws.String(issuer)
+	jwtAuthorizer.JwtConfiguration.Audience = audiences
+
+	jwtIngestScopes = splitList(ingestScopes)
+	jwtReadScopes = splitList(readScopes)
+}
+
+// Create the JWT authorizer, or update issuer and audience of the existing one
+func createOrUpdateJwtAuthorizer(apiId *string) (*string, error) {
+	authorizerId, err := getAuthorizerIdByName(apiId, jwtAuthorizer.Name)
+	if err == nil {
+		uai := apigatewayv2.UpdateAuthorizerInput{
+			ApiId:            apiId,
+			AuthorizerId:     authorizerId,
+			JwtConfiguration: jwtAuthorizer.JwtConfiguration,
+		}
+		if _, err := svc.apigateway.UpdateAuthorizer(dflCtx(), &uai); err != nil {
+			return nil, err
+		}
+
+		log.Printf("update authorizer %s, id: %s, issuer: %s\n",
+			*jwtAuthorizer.Name, *authorizerId, *jwtAuthorizer.JwtConfiguration.Issuer)
+
+		return authorizerId, nil
+	}
+
+	jwtAuthorizer.ApiId = apiId
+
+	caOut, err := svc.apigateway.CreateAuthorizer(dflCtx(), &jwtAuthorizer)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("create authorizer %s, id: %s, type: %s, issuer: %s, audience: %s\n",
+		*caOut.Name, *caOut.AuthorizerId, caOut.AuthorizerType,
+		*caOut.JwtConfiguration.Issuer, strings.Join(caOut.JwtConfiguration.Audience, ","))
+
+	return caOut.AuthorizerId, nil
+}
+
+func getRoutes(apiId *string) ([]apigtypes.Route, error) {
+	var routes []apigtypes.Route
+
+	gri := apigatewayv2.GetRoutesInput{ApiId: apiId, MaxResults: aws.String("1000")}
+	for {
+		grOut, err := svc.apigateway.GetRoutes(dflCtx(), &gri)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, grOut.Items...)
+
+		gri.NextToken = grOut.NextToken
+		if gri.NextToken == nil {
+			break
+		}
+	}
+
+	return routes, nil
+}
+
+func getRouteScopes(routeKey string) []string {
+	if strings.HasPrefix(routeKey, "GET ") {
+		return jwtReadScopes
+	}
+
+	return jwtIngestScopes
+}
+
+// Every route of the api requires a token, with the scopes of the route
+func addJwtAuthorizerToRoutes(apiId *string, authorizerId *string) error {
+	routes, err := getRoutes(apiId)
+	if err != nil {
+		return err
+	}
+
+	for _, apiRoute := range routes {
+		uri := apigatewayv2.UpdateRouteInput{
+			ApiId:               apiId,
+			RouteId:             apiRoute.RouteId,
+			AuthorizationType:   apigtypes.AuthorizationTypeJwt,
+			AuthorizerId:        authorizerId,
+			AuthorizationScopes: getRouteScopes(*apiRoute.RouteKey),
+		}
+
+		urOut, err := svc.apigateway.UpdateRoute(dflCtx(), &uri)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("update route %s (adding authorizer id: %s, with type: %s, scopes: %s)\n",
+			*urOut.RouteKey, *urOut.AuthorizerId, urOut.AuthorizationType,
+			strings.Join(urOut.AuthorizationScopes, ","))
+	}
+
+	return nil
+}
+
+// Detach the JWT authorizer from every route and delete it, if any
+func deleteJwtAuthorizer(apiId *string) {
+	authorizerId, err := getAuthorizerIdByName(apiId, jwtAuthorizer.Name)
+	if err != nil {
+		return
+	}
+
+	routes, err := getRoutes(apiId)
+	if err != nil {
+		log.Printf("unable to get routes: %v\n", err)
+		return
+	}
+
+	for _, apiRoute := range routes {
+		if aws.ToString(apiRoute.AuthorizerId) != *authorizerId {
+			continue
+		}
+
+		uri := apigatewayv2.UpdateRouteInput{
+			ApiId:               apiId,
+			RouteId:             apiRoute.RouteId,
+			AuthorizationType:   apigtypes.AuthorizationTypeNone,
+			AuthorizationScopes: []string{},
+		}
+
+		if _, err := svc.apigateway.UpdateRoute(dflCtx(), &uri); err != nil {
+			log.Printf("unable to update route %s: %v\n", *apiRoute.RouteKey, err)
+			return
+		}
+
+		log.Printf("update route %s (removing authorizer)\n", *apiRoute.RouteKey)
+	}
+
+	dai := apigatewayv2.DeleteAuthorizerInput{ApiId: apiId, AuthorizerId: authorizerId}
+	if _, err := svc.apigateway.DeleteAuthorizer(dflCtx(), &dai); err != nil {
+		log.Printf("unable to delete authorizer %s: %v\n", *jwtAuthorizer.Name, err)
+	} else {
+		log.Printf("delete authorizer %s, id: %s\n", *jwtAuthorizer.Name, *authorizerId)
+	}
+}
+
+func enableJwtAuth() error {
+	apiId, err := getApiId()
+	if err != nil {
+		return err
+	}
+
+	authorizerId, err := createOrUpdateJwtAuthorizer(apiId)
+	if err != nil {
+		return err
+	}
+
+	if err := addJwtAuthorizerToRoutes(apiId, authorizerId); err != nil {
+		return err
+	}
+
+	// the custom authorizer (if any) is no longer attached to any route
+	if customId, err := getAuthorizerId(apiId); err == nil {
+		dai := apigatewayv2.DeleteAuthorizerInput{ApiId: apiId, AuthorizerId: customId}
+		if _, err := svc.apigateway.DeleteAuthorizer(dflCtx(), &dai); err != nil {
+			log.Printf("unable to delete authorizer %s: %v\n", *authorizer.Name, err)
+		} else {
+			log.Printf("delete authorizer %s, id: %s\n", *authorizer.Name, *customId)
+		}
+	}
+
+	return updateIntegrationInput(apiId, JWT_INTEGRATION_INPUT)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/apigatewayv2"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+/*
+ * API keys registry
+ *
+ * The secret holds a registry of named keys (one per client/producer), each
+ * key stored as its SHA256 hash only, along with creation and (optional)
+ * expiration time. The authorizer looks up the hash of the "Authorization"
+ * header among the registry and returns the client name as its identity,
+ * which is recorded on each tuple's status rows.
+ *
+ * The registry also tells the authorizer how keys are presented (auth mode,
+ * see signing.go).
+ *
+ * NOTE: keys are hashed at rest in auth mode key only. In auth mode hmac the
+ * hash is the HMAC signing key itself (see signing.go), whoever reads the
+ * secret may sign requests as any client: the secret is then as sensitive as
+ * the keys themselves
+ *
+ * Option -a (and auth enable/rotate) sets the key of DEFAULT_CLIENT_ID.
+ * Secrets which are not a registry (e.g. created via exported templates)
+ * are taken by the authorizer as the key of DEFAULT_CLIENT_ID
+ */
+
+const DEFAULT_CLIENT_ID = "default"
+
+// Random keys generated by "auth add"
+const GENERATED_KEY_BYTES = 32
+
+// Client ids end up in the state machine input, keep them simple
+var clientIdRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type ApiKey struct {
+	ClientId string     `json:"clientId"`
+	Hash     string     `json:"hash"` // hex encoded SHA256 of the key
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+type KeyRegistry struct {
+	Mode string   `json:"mode,omitempty"` // AUTH_MODE_KEY if empty
+	Keys []ApiKey `json:"keys"`
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateKey() (string, error) {
+	keyBytes := make([]byte, GENERATED_KEY_BYTES)
+	if _, err := io.ReadFull(rand.Reader, keyBytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(keyBytes), nil
+}
+
+func checkClientId(clientId string) error {
+	if !clientIdRegexp.MatchString(clientId) {
+		return fmt.Errorf("invalid client id %s (allowed: %s)", clientId, clientIdRegexp)
+	}
+
+	return nil
+}
+
+// Registry currently stored in the secret, empty if there is no secret. A
+// secret which is not a registry is taken as the key of DEFAULT_CLIENT_ID,
+// as the authorizer does (see ../../lambdas/authorizer)
+func getKeyRegistry() (*KeyRegistry, error) {
+	var registry KeyRegistry
+
+	gsvi := secretsmanager.GetSecretValueInput{SecretId: secret.Name}
+	gsvOut, err := svc.secretsmanager.GetSecretValue(dflCtx(), &gsvi)
+	if err != nil {
+		var notFound *smtypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return &registry, nil
+		}
+		return nil, err
+	}
+
+	secretBytes := gsvOut.SecretBinary
+	if secretBytes == nil && gsvOut.SecretString != nil {
+		secretBytes = []byte(*gsvOut.SecretString)
+	}
+
+	if err := json.Unmarshal(secretBytes, &registry); err != nil || registry.Keys == nil {
+		log.Printf("secret %s is not a key registry, taken as the key of client %s\n",
+			*secret.Name, DEFAULT_CLIENT_ID)
+		return &KeyRegistry{
+			Keys: []ApiKey{{ClientId: DEFAULT_CLIENT_ID, Hash: hashKey(string(secretBytes))}},
+		}, nil
+	}
+
+	return &registry, nil
+}
+
+func putKeyRegistry(registry *KeyRegistry) error {
+	registryBytes, err := json.Marshal(registry)
+	if err != nil {
+		return fmt.Errorf("unable to marshal key registry: %w", err)
+	}
+
+	secret.SecretBinary = registryBytes
+	csOut, err := svc.secretsmanager.CreateSecret(dflCtx(), &secret)
+	if err != nil {
+		psvi := secretsmanager.PutSecretValueInput{
+			SecretId:     secret.Name,
+			SecretBinary: secret.SecretBinary,
+		}
+
+		psvOut, err := svc.secretsmanager.PutSecretValue(dflCtx(), &psvi)
+		if err != nil {
+			return fmt.Errorf("unable to create or update secret: %w", err)
+		}
+
+		log.Printf("update secret %s, arn: %s, keys: %d [not shown]\n",
+			*psvOut.Name, *psvOut.ARN, len(registry.Keys))
+	} else {
+		log.Printf("create secret %s, arn: %s, keys: %d [not shown]\n",
+			*csOut.Name, *csOut.ARN, len(registry.Keys))
+	}
+
+	return nil
+}
+
+// Add a key for a client, replacing its previous one (if any)
+func (registry *KeyRegistry) setKey(clientId string, key string, validFor time.Duration) {
+	apiKey := ApiKey{
+		ClientId: clientId,
+		Hash:     hashKey(key),
+		Created:  time.Now().UTC().Truncate(time.Second),
+	}
+	if validFor > 0 {
+		expires := apiKey.Created.Add(validFor)
+		apiKey.Expires = &expires
+	}
+
+	registry.removeKey(clientId)
+	registry.Keys = append(registry.Keys, apiKey)
+}
+
+func (registry *KeyRegistry) removeKey(clientId string) bool {
+	for i, apiKey := range registry.Keys {
+		if apiKey.ClientId == clientId {
+			registry.Keys = append(registry.Keys[:i], registry.Keys[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// since it is not a good idea to delete secret storage (it will take 7 days
+// to be able to create a new secret storage with the same name)
+// we are most likely going to update the existing secret storage by its name
+// with the newly-set authentication key
+//
+// Set the key of the default client, keeping the other clients' ones, and
+// the auth mode (unless empty)
+func createOrUpdateSecret(key *string, mode string) error {
+	registry, err := getKeyRegistry()
+	if err != nil {
+		return fmt.Errorf("unable to get key registry: %w", err)
+	}
+
+	registry.setKey(DEFAULT_CLIENT_ID, *key, 0)
+	if len(mode) > 0 {
+		registry.Mode = mode
+	}
+
+	return putKeyRegistry(registry)
+}
+
+func addClientKey(clientId string, key string, validFor time.Duration) error {
+	if err := checkClientId(clientId); err != nil {
+		return err
+	}
+
+	registry, err := getKeyRegistry()
+	if err != nil {
+		return err
+	}
+
+	registry.setKey(clientId, key, validFor)
+
+	return putKeyRegistry(registry)
+}
+
+func revokeClientKey(clientId string) error {
+	registry, err := getKeyRegistry()
+	if err != nil {
+		return err
+	}
+
+	if !registry.removeKey(clientId) {
+		return fmt.Errorf("no key for client %s", clientId)
+	}
+
+	return putKeyRegistry(registry)
+}
+
+func listClientKeys() error {
+	registry, err := getKeyRegistry()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-24s %-22s %-22s %s\n", "CLIENT", "CREATED", "EXPIRES", "HASH")
+	for _, apiKey := range registry.Keys {
+		expires := "never"
+		if apiKey.Expires != nil {
+			expires = apiKey.Expires.Format(time.RFC3339)
+			if apiKey.Expires.Before(time.Now()) {
+				expires += " (expired)"
+			}
+		}
+
+		// hand-edited registries may hold anything
+		hash := apiKey.Hash
+		if len(hash) > 12 {
+			hash = hash[:12] + "..."
+		}
+
+		fmt.Printf("%-24s %-22s %-22s %s\n", apiKey.ClientId,
+			apiKey.Created.Format(time.RFC3339), expires, hash)
+	}
+
+	return nil
+}
+
+// Pass client identity to the state machine (or stop doing it) on an
+// already deployed integration
+func updateIntegrationInput(apiId *string, input string) error {
+	routeId, err := getRouteId(apiId)
+	if err != nil {
+		return err
+	}
+
+	grOut, err := svc.apigateway.GetRoute(dflCtx(),
+		&apigatewayv2.GetRouteInput{ApiId: apiId, RouteId: routeId})
+	if err != nil {
+		return err
+	}
+
+	if grOut.Target == nil {
+		return errors.New("route has no target")
+	}
+
+	integrationId, found := strings.CutPrefix(*grOut.Target, "integrations/")
+	if !found {
+		return fmt.Errorf("unexpected route target %s", *grOut.Target)
+	}
+
+	giOut, err := svc.apigateway.GetIntegration(dflCtx(),
+		&apigatewayv2.GetIntegrationInput{ApiId: apiId, IntegrationId: &integrationId})
+	if err != nil {
+		return err
+	}
+
+	requestParameters := giOut.RequestParameters
+	requestParameters["Input"] = input
+
+	uii := apigatewayv2.UpdateIntegrationInput{
+		ApiId:             apiId,
+		IntegrationId:     &integrationId,
+		RequestParameters: requestParameters,
+	}
+	if _, err := svc.apigateway.UpdateIntegration(dflCtx(), &uii); err != nil {
+		return err
+	}
+
+	log.Printf("update integration %s, input: %s\n", integrationId, input)
+
+	return nil
+}
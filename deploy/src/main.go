@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -173,6 +174,7 @@ func createStepFunction() *string {
 		for _, smItem := range lsmOut.StateMachines {
 			if *smItem.Name == *stateMachine.Name {
 				log.Printf("unable to create sfn %s: already exists\n", *smItem.Name)
+				updateStepFunction(smItem.StateMachineArn)
 				return smItem.StateMachineArn
 			}
 		}
@@ -186,6 +188,7 @@ func createStepFunction() *string {
 	// If non-existant, create a new state machine from its AML definition
 	amlDef := getStateMachineDefinition()
 	stateMachine.Definition = &amlDef
+	stateMachine.RoleArn = getRoleArn(*stateMachine.Name)
 
 	opOut, err := svc.sfn.CreateStateMachine(dflCtx(), &stateMachine)
 	if err != nil {
@@ -197,30 +200,86 @@ func createStepFunction() *string {
 	}
 }
 
+// Update existing state machine definition, so that it references lambdas
+// the same way a newly created one would (e.g. by their aliases)
+func updateStepFunction(sfnArn *string) {
+	amlDef := getStateMachineDefinition()
+
+	usmi := sfn.UpdateStateMachineInput{
+		StateMachineArn: sfnArn,
+		Definition:      &amlDef,
+		RoleArn:         getRoleArn(*stateMachine.Name),
+	}
+
+	_, err := svc.sfn.UpdateStateMachine(dflCtx(), &usmi)
+	if err != nil {
+		log.Printf("unable to update sfn definition: %v\n", err)
+	} else {
+		log.Printf("update sfn arn %s (definition)\n", *sfnArn)
+	}
+}
+
 // Create lambdas
 func createLambdas(baseDir string) {
 	for _, lmbd := range lambdas {
-		zip, err := loadFunctionZip(baseDir, *lmbd.FunctionName)
-		if err != nil {
-			log.Printf("unable to load function zip: %v\n", err)
-		} else {
-			lmbd.Code = &lmbdtypes.FunctionCode{ZipFile: zip}
-			opOut, err := svc.lambda.CreateFunction(dflCtx(), &lmbd)
-			if err != nil {
-				log.Printf("unable to create lambda %s: %v\n",
-					*lmbd.FunctionName, err)
-			} else {
-				lambdasArns = append(lambdasArns, *opOut.FunctionArn)
+		createLambda(lmbd, baseDir)
+	}
+}
 
-				log.Printf("create lambda %s, arn: %s, state: %s (reason: %s)\n",
-					*opOut.FunctionName, *opOut.FunctionArn,
-					opOut.State, *opOut.StateReason)
+func createLambda(lmbd lambda.CreateFunctionInput, baseDir string) bool {
+	zip, err := loadFunctionZip(baseDir, *lmbd.FunctionName, lmbd.Architectures)
+	if err != nil {
+		log.Printf("unable to load function zip: %v\n", err)
+		return false
+	}
 
-				log.Printf("\twith deployment package of size %d B, sha256: %s, handler: %s\n",
-					opOut.CodeSize, *opOut.CodeSha256,
-					*opOut.Handler)
-			}
+	lmbd.Code = &lmbdtypes.FunctionCode{ZipFile: zip}
+	lmbd.Role = getRoleArn(*lmbd.FunctionName)
+	opOut, err := svc.lambda.CreateFunction(dflCtx(), &lmbd)
+	if err != nil {
+		log.Printf("unable to create lambda %s: %v\n",
+			*lmbd.FunctionName, err)
+		return false
+	}
+
+	lambdasArns = append(lambdasArns, *opOut.FunctionArn)
+
+	log.Printf("create lambda %s, arn: %s, state: %s (reason: %s)\n",
+		*opOut.FunctionName, *opOut.FunctionArn,
+		opOut.State, *opOut.StateReason)
+
+	log.Printf("\twith deployment package of size %d B, sha256: %s, handler: %s\n",
+		opOut.CodeSize, *opOut.CodeSha256,
+		*opOut.Handler)
+
+	putReservedConcurrency(lmbd.FunctionName)
+
+	return true
+}
+
+// Reserve concurrency for a lambda, as per lambdasReservedConcurrency
+// if the lambda is not listed there, whatever was reserved is removed
+func putReservedConcurrency(name *string) {
+	concurrency, ok := lambdasReservedConcurrency[*name]
+	if !ok {
+		dfci := lambda.DeleteFunctionConcurrencyInput{FunctionName: name}
+		_, err := svc.lambda.DeleteFunctionConcurrency(dflCtx(), &dfci)
+		if err != nil {
+			log.Printf("unable to remove reserved concurrency of lambda %s: %v\n",
+				*name, err)
 		}
+		return
+	}
+
+	pfci := lambda.PutFunctionConcurrencyInput{
+		FunctionName:                 name,
+		ReservedConcurrentExecutions: aws.Int32(concurrency),
+	}
+	_, err := svc.lambda.PutFunctionConcurrency(dflCtx(), &pfci)
+	if err != nil {
+		log.Printf("unable to reserve concurrency for lambda %s: %v\n", *name, err)
+	} else {
+		log.Printf("reserve concurrency for lambda %s: %d\n", *name, concurrency)
 	}
 }
 
@@ -231,6 +290,7 @@ func createLambdas(baseDir string) {
 func mergeRouteWithIntegration(apiId *string, sfnArn *string) *string {
 	integration.ApiId = apiId
 	integration.RequestParameters["StateMachineArn"] = *sfnArn
+	integration.CredentialsArn = getRoleArn(*api.Name)
 
 	// search for the integration, if it is already existing the client will
 	// just use it
@@ -308,43 +368,11 @@ func mergeRouteWithIntegration(apiId *string, sfnArn *string) *string {
 	return routeOpOut.RouteId
 }
 
-// authorizer lambda will be added if and only if authentication is required
+// authorizer lambda will be added if and only if authentication is required,
+// client identity (returned by the authorizer) is then passed to the pipeline
 func addAuthorizerLambda() {
-	lambdas = append(lambdas, lambda.CreateFunctionInput{
-		FunctionName:  aws.String("authorizer"),
-		Role:          &iamRoleArn,
-		PackageType:   lmbdtypes.PackageTypeZip,
-		Architectures: []lmbdtypes.Architecture{lmbdtypes.ArchitectureX8664},
-		Runtime:       lmbdtypes.RuntimeProvidedal2023,
-		Handler:       aws.String("bootstrap"),
-		Timeout:       aws.Int32(10),
-	})
-}
-
-// since it is not a good idea to delete secret storage (it will take 7 days
-// to be able to create a new secret storage with the same name)
-// we are most likely going to update the existing secret storage by its name
-// with the newly-set authentication key
-func createOrUpdateSecret(key *string) {
-	secret.SecretBinary = []byte(*key)
-	csOut, err := svc.secretsmanager.CreateSecret(dflCtx(), &secret)
-	if err != nil {
-		psvi := secretsmanager.PutSecretValueInput{
-			SecretId:     secret.Name,
-			SecretBinary: secret.SecretBinary,
-		}
-
-		psvOut, err := svc.secretsmanager.PutSecretValue(dflCtx(), &psvi)
-		if err != nil {
-			log.Printf("unable to create or update secret: %v\n", err)
-		} else {
-			log.Printf("update secret %s, arn: %s, key: [not shown]\n",
-				*psvOut.Name, *psvOut.ARN)
-		}
-	} else {
-		log.Printf("create secret %s, arn: %s, key: [not shown]\n",
-			*csOut.Name, *csOut.ARN)
-	}
+	lambdas = append(lambdas, authorizerLambda)
+	integration.RequestParameters["Input"] = AUTH_INTEGRATION_INPUT
 }
 
 // This authorizer will invoke the lambda "authorizer", which will get the
@@ -354,6 +382,7 @@ func createAuthorizer(apiId *string) *string {
 	authUri := getAuthorizerUri()
 	authorizer.ApiId = apiId
 	authorizer.AuthorizerUri = &authUri
+	authorizer.AuthorizerCredentialsArn = getRoleArn(*api.Name)
 
 	caOut, err := svc.apigateway.CreateAuthorizer(dflCtx(), &authorizer)
 	if err != nil {
@@ -370,6 +399,18 @@ func createAuthorizer(apiId *string) *string {
 	return caOut.AuthorizerId
 }
 
+// API Gateway caches authorizer results (by "Authorization" header) for ttl
+// seconds, 0 to disable caching. A revoked key keeps working until then
+const MAX_AUTHORIZER_TTL = 3600
+
+func setAuthorizerTtl(ttl int) {
+	if ttl < 0 || ttl > MAX_AUTHORIZER_TTL {
+		log.Fatalf("authorizer ttl must be between 0 and %d seconds", MAX_AUTHORIZER_TTL)
+	}
+
+	authorizer.AuthorizerResultTtlInSeconds = aws.Int32(int32(ttl))
+}
+
 // Authorizer can be easily added to the HTTP route which needs authentication
 // No further integration needed, "builtin" support by AWS
 func addAuthorizerToRoute(authorizerId *string, routeId *string) {
@@ -405,9 +446,9 @@ func deleteApi(apiId *string) {
 }
 
 // Delete DynamoDB tables
-func deleteTables() {
-	for _, table := range tables {
-		dti := dynamodb.DeleteTableInput{TableName: table.TableName}
+func deleteTables(tableNames []*string) {
+	for _, tableName := range tableNames {
+		dti := dynamodb.DeleteTableInput{TableName: tableName}
 		opOut, err := svc.dynamodb.DeleteTable(dflCtx(), &dti)
 		if err != nil {
 			log.Printf("unable to delete table %s: %v\n", *dti.TableName, err)
@@ -422,54 +463,77 @@ func deleteTables() {
 // Delete lambdas: if authentication was not enabled during deployment time
 // authorizer lambda deletion will fail, program just goes on...
 func deleteLambdas() {
-	addAuthorizerLambda()
 	for _, lmbd := range lambdas {
-		dfi := lambda.DeleteFunctionInput{FunctionName: lmbd.FunctionName}
-		_, err := svc.lambda.DeleteFunction(dflCtx(), &dfi)
-		if err != nil {
-			log.Printf("unable to delete lambda %s: %v\n", *dfi.FunctionName, err)
-		} else {
-			log.Printf("delete lambda %s\n", *lmbd.FunctionName)
-		}
+		deleteLambda(lmbd.FunctionName)
 	}
 }
 
-// Delete step function: takes some time to delete this resource
-// If next deployment is made too soon after un-deployment then
-// creation will most likely fail
-func deleteStepFunction() {
-	lsmi := sfn.ListStateMachinesInput{MaxResults: 1000}
+func deleteLambda(name *string) {
+	dfi := lambda.DeleteFunctionInput{FunctionName: name}
+	_, err := svc.lambda.DeleteFunction(dflCtx(), &dfi)
+	if err != nil {
+		log.Printf("unable to delete lambda %s: %v\n", *dfi.FunctionName, err)
+	} else {
+		log.Printf("delete lambda %s\n", *name)
+	}
+}
 
-	for {
-		lssmOut, err := svc.sfn.ListStateMachines(dflCtx(), &lsmi)
+// Detach authorizer from the route and delete it, leaving the api in place
+// (deleting the api deletes its authorizers as well)
+func deleteAuthorizer(apiId *string) {
+	routeId, err := getRouteId(apiId)
+	if err != nil {
+		log.Printf("unable to find route %s: %v\n", *route.RouteKey, err)
+	} else {
+		uri := apigatewayv2.UpdateRouteInput{
+			ApiId:             apiId,
+			RouteId:           routeId,
+			AuthorizationType: apigtypes.AuthorizationTypeNone,
+		}
+
+		urOut, err := svc.apigateway.UpdateRoute(dflCtx(), &uri)
 		if err != nil {
-			log.Printf("unable to list state machines: %v\n", err)
-			break
+			log.Printf("unable to update route %s: %v\n", *route.RouteKey, err)
 		} else {
-			for _, sm := range lssmOut.StateMachines {
-				if *sm.Name == *stateMachine.Name {
-					dsmi := sfn.DeleteStateMachineInput{StateMachineArn: sm.StateMachineArn}
-					_, err := svc.sfn.DeleteStateMachine(dflCtx(), &dsmi)
-					if err != nil {
-						log.Printf("unable to delete state machine %s: %v\n", *sm.Name, err)
-					} else {
-						log.Printf("delete sfn %s, arn: %s\n",
-							*sm.Name, *sm.StateMachineArn)
-					}
+			log.Printf("update route %s (removing authorizer, type: %s)\n",
+				*urOut.RouteKey, urOut.AuthorizationType)
+		}
+	}
 
-					return
-				}
-			}
+	authorizerId, err := getAuthorizerId(apiId)
+	if err != nil {
+		log.Printf("unable to find authorizer %s: %v\n", *authorizer.Name, err)
+		return
+	}
 
-			lsmi.NextToken = lssmOut.NextToken
+	dai := apigatewayv2.DeleteAuthorizerInput{ApiId: apiId, AuthorizerId: authorizerId}
+	if _, err := svc.apigateway.DeleteAuthorizer(dflCtx(), &dai); err != nil {
+		log.Printf("unable to delete authorizer %s: %v\n", *authorizer.Name, err)
+	} else {
+		log.Printf("delete authorizer %s, id: %s\n", *authorizer.Name, *authorizerId)
+	}
+}
 
-			if lsmi.NextToken == nil {
-				break
-			}
-		}
+// Delete step function: takes some time to delete this resource
+// If next deployment is made too soon after un-deployment then
+// creation will most likely fail (see waitStepFunctionDeleted)
+func deleteStepFunction() *string {
+	sfnArn, err := getStepFunctionArn()
+	if err != nil {
+		log.Printf("unable to find sfn %s: %v\n", *stateMachine.Name, err)
+		return nil
 	}
 
-	log.Printf("unable to find sfn %s\n", *stateMachine.Name)
+	dsmi := sfn.DeleteStateMachineInput{StateMachineArn: sfnArn}
+	_, err = svc.sfn.DeleteStateMachine(dflCtx(), &dsmi)
+	if err != nil {
+		log.Printf("unable to delete state machine %s: %v\n", *stateMachine.Name, err)
+		return nil
+	}
+
+	log.Printf("delete sfn %s, arn: %s\n", *stateMachine.Name, *sfnArn)
+
+	return sfnArn
 }
 
 // Delete HTTP routes (along with its authorizer if present)
@@ -594,10 +658,22 @@ func deleteSecret() {
  * AWS update resources
  */
 
-func coreUpdateLambda(name *string, arch *[]lmbdtypes.Architecture, base *string) {
-	zipBytes, err := loadFunctionZip(*base, *name)
+func coreUpdateLambda(name *string, arch *[]lmbdtypes.Architecture, base *string,
+	canaryPercent int, maxWait time.Duration) {
+	zipBytes, err := loadFunctionZip(*base, *name, *arch)
 	if err != nil {
 		log.Printf("unable to load zip for %s: %v\n", *name, err)
+	} else if isCodeDeployed(name, *arch, zipBytes) {
+		log.Printf("lambda %s code unchanged (sha256: %s), skipping code update\n",
+			*name, getCodeSha256(zipBytes))
+
+		// configuration (see updateLambdaConfiguration) may have changed
+		if isLatestRouted(name) {
+			log.Printf("alias %s already routes to the current configuration\n",
+				qualifiedLambdaName(name))
+		} else {
+			publishAndRouteLambda(name, canaryPercent, maxWait)
+		}
 	} else {
 		ufci := lambda.UpdateFunctionCodeInput{
 			FunctionName:  name,
@@ -617,49 +693,115 @@ func coreUpdateLambda(name *string, arch *[]lmbdtypes.Architecture, base *string
 			log.Printf("\twith deployment package of size %d B, sha256: %s, handler: %s\n",
 				opOut.CodeSize, *opOut.CodeSha256,
 				*opOut.Handler)
+
+			publishAndRouteLambda(name, canaryPercent, maxWait)
 		}
 	}
 }
 
-// Update one, two, three or all lambdas
-// if authorizer is not already present (auth disabled)
-// attempting to update it or including it in the update
-// will result in fail (program will NOT terminate)
-func updateLambdas(base string, csl string) {
-	if csl != "all" {
-		lambdaNames := strings.Split(csl, ",")
-
-		for _, lambdaName := range lambdaNames {
-			lambdaName = strings.TrimSpace(lambdaName)
-			if len(lambdaName) == 0 {
-				continue
-			}
+// Lambda names from comma-separated list or "all": authorizer is allowed
+// even if it is not in lambdas (auth disabled at deployment time)
+func getLambdaNames(csl string) []string {
+	var names []string
 
-			var archs []lmbdtypes.Architecture
-			found := false
+	if csl == "all" {
+		for _, myLambda := range lambdas {
+			names = append(names, *myLambda.FunctionName)
+		}
 
-			for _, myLambda := range lambdas {
-				if *myLambda.FunctionName == lambdaName {
-					archs = myLambda.Architectures
-					found = true
-					break
-				}
-			}
+		return names
+	}
 
-			if !found && lambdaName != "authorizer" {
-				log.Printf("unable to find lambda %s\n", lambdaName)
-				continue
+	for _, lambdaName := range strings.Split(csl, ",") {
+		lambdaName = strings.TrimSpace(lambdaName)
+		if len(lambdaName) == 0 {
+			continue
+		}
+
+		found := lambdaName == "authorizer"
+		for _, myLambda := range lambdas {
+			if *myLambda.FunctionName == lambdaName {
+				found = true
+				break
 			}
+		}
 
-			coreUpdateLambda(&lambdaName, &archs, &base)
+		if !found {
+			log.Printf("unable to find lambda %s\n", lambdaName)
+			continue
 		}
-	} else {
-		for _, myLambda := range lambdas {
-			coreUpdateLambda(myLambda.FunctionName, &myLambda.Architectures, &base)
+
+		names = append(names, lambdaName)
+	}
+
+	return names
+}
+
+// Whether a package is the very same (see build.go) as the deployed code
+func isCodeDeployed(name *string, archs []lmbdtypes.Architecture, zipBytes []byte) bool {
+	gfci := lambda.GetFunctionConfigurationInput{FunctionName: name}
+	opOut, err := svc.lambda.GetFunctionConfiguration(dflCtx(), &gfci)
+	if err != nil {
+		log.Printf("unable to get lambda %s configuration: %v\n", *name, err)
+		return false
+	}
+
+	if len(archs) > 0 && (len(opOut.Architectures) == 0 || opOut.Architectures[0] != archs[0]) {
+		return false
+	}
+
+	return opOut.CodeSha256 != nil && *opOut.CodeSha256 == getCodeSha256(zipBytes)
+}
+
+// Update one, two, three or all lambdas
+// if authorizer is not already present (auth disabled)
+// attempting to update it or including it in the update
+// will result in fail (program will NOT terminate)
+//
+// Each updated lambda gets a new version, which its alias is routed
+// to (entirely or canaryPercent% of invocations, see versions.go)
+func updateLambdas(base string, csl string, canaryPercent int, maxWait time.Duration) {
+	for _, lambdaName := range getLambdaNames(csl) {
+		myLambda := getLambdaConfig(lambdaName)
+		if myLambda == nil {
+			log.Printf("unable to find configuration of lambda %s\n", lambdaName)
+			continue
 		}
+
+		updateLambdaConfiguration(myLambda, maxWait)
+		coreUpdateLambda(&lambdaName, &myLambda.Architectures, &base, canaryPercent, maxWait)
 	}
 }
 
+// Update memory, timeout and environment variables (as per config.go) of an
+// already deployed lambda, along with its reserved concurrency.
+// Code update must wait for the configuration update to complete
+func updateLambdaConfiguration(myLambda *lambda.CreateFunctionInput, maxWait time.Duration) {
+	ufci := lambda.UpdateFunctionConfigurationInput{
+		FunctionName: myLambda.FunctionName,
+		MemorySize:   myLambda.MemorySize,
+		Timeout:      myLambda.Timeout,
+		Environment:  myLambda.Environment,
+	}
+	if ufci.Environment == nil {
+		// otherwise previously set variables would be kept
+		ufci.Environment = &lmbdtypes.Environment{Variables: map[string]string{}}
+	}
+
+	opOut, err := svc.lambda.UpdateFunctionConfiguration(dflCtx(), &ufci)
+	if err != nil {
+		log.Printf("unable to update lambda %s configuration: %v\n",
+			*ufci.FunctionName, err)
+		return
+	}
+
+	log.Printf("update lambda %s configuration, memory: %d MB, timeout: %d s\n",
+		*opOut.FunctionName, *opOut.MemorySize, *opOut.Timeout)
+
+	waitLambdaUpdated(myLambda.FunctionName, maxWait)
+	putReservedConcurrency(myLambda.FunctionName)
+}
+
 /*
  * Various util functions
  */
@@ -677,11 +819,12 @@ func getAuthorizerUri() string {
 		lambdasArns = append(lambdasArns, *gfOut.Configuration.FunctionArn)
 	}
 
-	funArn := &lambdasArns[len(lambdasArns)-1]
+	// invoke authorizer by its alias
+	funArn := lambdasArns[len(lambdasArns)-1] + ":" + LAMBDA_ALIAS
 	return fmt.Sprintf(
 		"arn:aws:apigateway:%s:lambda:path/2015-03-31/functions/%s/invocations",
 		AWS_REGION,
-		*funArn)
+		funArn)
 }
 
 func obtainIamRole() {
@@ -721,22 +864,98 @@ func getApiId() (*string, error) {
 	return nil, errors.New("unable to find api")
 }
 
+// Looked up by name, the state machine being the one of this deployment
+func getStepFunctionArn() (*string, error) {
+	lsmi := sfn.ListStateMachinesInput{MaxResults: 1000}
+
+	for {
+		lssmOut, err := svc.sfn.ListStateMachines(dflCtx(), &lsmi)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sm := range lssmOut.StateMachines {
+			if *sm.Name == *stateMachine.Name {
+				return sm.StateMachineArn, nil
+			}
+		}
+
+		lsmi.NextToken = lssmOut.NextToken
+		if lsmi.NextToken == nil {
+			break
+		}
+	}
+
+	return nil, errors.New("unable to find state machine")
+}
+
+// lambdas are invoked by their alias (name:alias), never $LATEST
 func getStateMachineDefinition() string {
 	return fmt.Sprintf(SFN_AML_DEFINITION_FMT,
-		*lambdas[0].FunctionName, //validate
-		*lambdas[1].FunctionName, //transform
-		*lambdas[4].FunctionName, //flagTransformFailed
-		*lambdas[3].FunctionName, //flagValidateFailed
-		*lambdas[2].FunctionName, //store
-		*lambdas[5].FunctionName, //flagStoreFailed
-		*lambdas[4].FunctionName, //flagTransformFailed
-		*lambdas[3].FunctionName, //flagValidateFailed
-		*lambdas[3].FunctionName, //flagValidateFailed
+		qualifiedLambdaName(lambdas[0].FunctionName), //validate
+		qualifiedLambdaName(lambdas[1].FunctionName), //transform
+		qualifiedLambdaName(lambdas[4].FunctionName), //flagTransformFailed
+		qualifiedLambdaName(lambdas[3].FunctionName), //flagValidateFailed
+		qualifiedLambdaName(lambdas[2].FunctionName), //store
+		qualifiedLambdaName(lambdas[5].FunctionName), //flagStoreFailed
+		qualifiedLambdaName(lambdas[4].FunctionName), //flagTransformFailed
+		qualifiedLambdaName(lambdas[3].FunctionName), //flagValidateFailed
+		qualifiedLambdaName(lambdas[3].FunctionName), //flagValidateFailed
 	)
 }
 
-func loadFunctionZip(pkgs string, name string) ([]byte, error) {
-	path := pkgs + "/" + name + "/" + name + ".zip"
+// Lambda configuration by name (authorizer included even if auth is disabled)
+func getLambdaConfig(name string) *lambda.CreateFunctionInput {
+	for i := range lambdas {
+		if *lambdas[i].FunctionName == name {
+			return &lambdas[i]
+		}
+	}
+
+	if *authorizerLambda.FunctionName == name {
+		return &authorizerLambda
+	}
+
+	return nil
+}
+
+// Go arch the deployment package must have been built for
+func getGoArch(archs []lmbdtypes.Architecture) string {
+	if len(archs) > 0 && archs[0] == lmbdtypes.ArchitectureArm64 {
+		return "arm64"
+	}
+
+	return "amd64"
+}
+
+// Override the architecture of all of the lambdas (option -arch)
+func setLambdasArch(arch string) {
+	archs := []lmbdtypes.Architecture{lmbdtypes.Architecture(arch)}
+
+	for i := range lambdas {
+		lambdas[i].Architectures = archs
+	}
+	authorizerLambda.Architectures = archs
+}
+
+// Packages are built per arch (pkgs/name/name-goarch.zip), packages built
+// before arm64 support (pkgs/name/name.zip) are still used for x86_64
+func getFunctionZipPath(pkgs string, name string, archs []lmbdtypes.Architecture) string {
+	goArch := getGoArch(archs)
+
+	path := pkgs + "/" + name + "/" + name + "-" + goArch + ".zip"
+	if _, err := os.Stat(path); os.IsNotExist(err) && goArch == "amd64" {
+		legacyPath := pkgs + "/" + name + "/" + name + ".zip"
+		if _, err := os.Stat(legacyPath); err == nil {
+			return legacyPath
+		}
+	}
+
+	return path
+}
+
+func loadFunctionZip(pkgs string, name string, archs []lmbdtypes.Architecture) ([]byte, error) {
+	path := getFunctionZipPath(pkgs, name, archs)
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		return nil, err
@@ -770,6 +989,18 @@ type Cmdline struct {
 	updateLambdas    string
 	authorizationKey string
 	forceSecretDel   bool
+	waitTimeout      time.Duration
+	maxParallelSteps int
+	leastPrivilege   bool
+	canaryPercent    int
+	arch             string
+	pitr             bool
+	authTtl          int
+	authMode         string
+	jwtIssuer        string
+	jwtAudience      string
+	jwtScopes        string
+	jwtReadScopes    string
 }
 
 func parseCmdline() Cmdline {
@@ -811,11 +1042,188 @@ func parseCmdline() Cmdline {
 			" for the next 7 days.",
 	)
 
+	flag.DurationVar(
+		&cmdline.waitTimeout,
+		"w",
+		5*time.Minute,
+		"Max time to wait for each resource to become ACTIVE (or to be deleted)."+
+			" 0 to not wait at all",
+	)
+
+	flag.IntVar(
+		&cmdline.maxParallelSteps,
+		"j",
+		4,
+		"Max number of independent deployment steps to run concurrently",
+	)
+
+	flag.BoolVar(
+		&cmdline.leastPrivilege,
+		"r",
+		false,
+		"Create a least-privilege IAM role for each lambda, the state machine and the api"+
+			" (falling back to the shared role if not permitted). Along with -d, delete those roles",
+	)
+
+	flag.IntVar(
+		&cmdline.canaryPercent,
+		"c",
+		0,
+		"Along with -u, route only this percentage of invocations to the new"+
+			" lambda versions (canary), see promote and rollback subcommands",
+	)
+
+	flag.StringVar(
+		&cmdline.arch,
+		"arch",
+		"",
+		"Override the architecture of all of the lambdas (x86_64 or arm64),"+
+			" packages for that arch must have been built",
+	)
+
+	flag.BoolVar(
+		&cmdline.pitr,
+		"pitr",
+		false,
+		"Enable point-in-time recovery on created tables, see also backup and restore subcommands",
+	)
+
+	flag.IntVar(
+		&cmdline.authTtl,
+		"auth-ttl",
+		0,
+		"Along with -a, seconds API Gateway caches authorization results for (0: no caching)",
+	)
+
+	flag.StringVar(
+		&cmdline.authMode,
+		"auth-mode",
+		AUTH_MODE_KEY,
+		"How producers authenticate: "+AUTH_MODE_KEY+" (-a key sent as is), "+
+			AUTH_MODE_HMAC+" (requests signed with -a key, the secret then holds signing keys: not hashed at rest) or "+
+			AUTH_MODE_JWT+
+			" (OIDC tokens, see -jwt-issuer and -jwt-audience)",
+	)
+
+	flag.StringVar(
+		&cmdline.jwtIssuer,
+		"jwt-issuer",
+		"",
+		"Along with -auth-mode jwt, https url of the token issuer (e.g. OIDC provider)",
+	)
+
+	flag.StringVar(
+		&cmdline.jwtAudience,
+		"jwt-audience",
+		"",
+		"Along with -auth-mode jwt, comma-separated audiences, tokens must be issued for one of them",
+	)
+
+	flag.StringVar(
+		&cmdline.jwtScopes,
+		"jwt-scopes",
+		JWT_INGEST_SCOPE,
+		"Along with -auth-mode jwt, comma-separated scopes required to ingest (POST /store)",
+	)
+
+	flag.StringVar(
+		&cmdline.jwtReadScopes,
+		"jwt-read-scopes",
+		JWT_READ_SCOPE,
+		"Along with -auth-mode jwt, comma-separated scopes required on read (GET) routes",
+	)
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [options] | <subcommand> [options]\n\n", os.Args[0])
+		fmt.Fprintln(out, "Subcommands (use <subcommand> -h to get help on its options):")
+		for _, sc := range subcommands {
+			fmt.Fprintf(out, "  %-10s %s\n", sc.name, sc.description)
+		}
+		fmt.Fprintln(out, "\nOptions:")
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
 	return cmdline
 }
 
+/*
+ * Subcommands: "deploy <subcommand> [options]", each one parses its own
+ * options. Without any subcommand, the program deploys, undeploys (-d)
+ * or updates lambdas (-u) as usual
+ */
+
+type Subcommand struct {
+	name        string
+	description string
+	run         func(args []string)
+}
+
+var subcommands = []Subcommand{
+	{
+		name:        "destroy",
+		description: "Delete only some components (final data table protected)",
+		run:         destroyMain,
+	},
+	{
+		name:        "auth",
+		description: "Enable, disable or rotate authentication on an existing deployment",
+		run:         authMain,
+	},
+	{
+		name:        "backup",
+		description: "Export tables to local NDJSON or Parquet files",
+		run:         backupMain,
+	},
+	{
+		name:        "restore",
+		description: "Import tables from local NDJSON or Parquet files",
+		run:         restoreMain,
+	},
+	{
+		name:        "status",
+		description: "Print endpoint, ARNs, table item counts and authorizer state",
+		run:         statusMain,
+	},
+	{
+		name:        "build",
+		description: "Build lambda deployment packages (reproducible zips, with hashes)",
+		run:         buildMain,
+	},
+	{
+		name:        "export",
+		description: "Export deployment as CloudFormation/SAM template or Terraform configuration",
+		run:         exportMain,
+	},
+	{
+		name:        "promote",
+		description: "Route all invocations to canary lambda versions",
+		run:         promoteMain,
+	},
+	{
+		name:        "rollback",
+		description: "Drop canary lambda versions (or go back to previous ones), optionally only if failure rates spike",
+		run:         rollbackMain,
+	},
+}
+
+func runSubcommandIfAny() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	for _, sc := range subcommands {
+		if os.Args[1] == sc.name {
+			sc.run(os.Args[2:])
+			return true
+		}
+	}
+
+	return false
+}
+
 func loadAwsConfig() {
 	awsCfg, err := config.LoadDefaultConfig(
 		dflCtx(),
@@ -849,18 +1257,7 @@ func endIgnoreInteruption(c chan os.Signal) {
 	close(c)
 }
 
-func getApiIdMayFail(apiId **string) {
-	newApiId, err := getApiId()
-	if err != nil {
-		log.Println("unable to get api id")
-		log.Println("cannot go further")
-		log.Fatalf("stopping immediately (reason: %v)", err)
-	}
-
-	*apiId = newApiId
-}
-
-func getRouteIdMayFail(apiId *string, routeId **string) {
+func getRouteId(apiId *string) (*string, error) {
 	gri := apigatewayv2.GetRoutesInput{
 		ApiId:      apiId,
 		MaxResults: aws.String("1000"),
@@ -869,24 +1266,29 @@ func getRouteIdMayFail(apiId *string, routeId **string) {
 	for {
 		grOut, err := svc.apigateway.GetRoutes(dflCtx(), &gri)
 		if err != nil {
-			log.Fatalf("unable to get existing routes: %v", err)
+			return nil, err
 		}
 
 		for _, routeItem := range grOut.Items {
 			if *routeItem.RouteKey == *route.RouteKey {
-				*routeId = routeItem.RouteId
-				return
+				return routeItem.RouteId, nil
 			}
 		}
 
 		gri.NextToken = grOut.NextToken
 		if gri.NextToken == nil {
-			log.Fatalln("unable to find any matching route")
+			break
 		}
 	}
+
+	return nil, errors.New("unable to find any matching route")
 }
 
-func getAuthorizerIdMayFail(apiId *string, authorizerId **string) {
+func getAuthorizerId(apiId *string) (*string, error) {
+	return getAuthorizerIdByName(apiId, authorizer.Name)
+}
+
+func getAuthorizerIdByName(apiId *string, name *string) (*string, error) {
 	gai := apigatewayv2.GetAuthorizersInput{
 		ApiId:      apiId,
 		MaxResults: aws.String("1000"),
@@ -895,122 +1297,405 @@ func getAuthorizerIdMayFail(apiId *string, authorizerId **string) {
 	for {
 		gaOut, err := svc.apigateway.GetAuthorizers(dflCtx(), &gai)
 		if err != nil {
-			log.Fatalf("unable to get existing authorizers: %v", err)
+			return nil, err
 		}
 
 		for _, authorizerItem := range gaOut.Items {
-			if *authorizerItem.Name == *authorizer.Name {
-				*authorizerId = authorizerItem.AuthorizerId
-				return
+			if *authorizerItem.Name == *name {
+				return authorizerItem.AuthorizerId, nil
 			}
 		}
 
 		gai.NextToken = gaOut.NextToken
 		if gai.NextToken == nil {
-			log.Fatalln("unable to find any matching authorizer")
+			break
 		}
 	}
+
+	return nil, errors.New("unable to find any matching authorizer")
 }
 
-func main() {
-	checkAwsCredentialsFile()
+/*
+ * Deployment and undeployment steps (see steps.go)
+ *
+ * Values produced by a step (api id, sfn arn, ...) are shared via
+ * DeployState and are read only by steps depending on the one writing them
+ */
 
-	cmdline := parseCmdline()
+type DeployState struct {
+	sfnArn       *string
+	apiId        *string
+	routeId      *string
+	stageName    *string
+	authorizerId *string
+}
 
-	loadAwsConfig()
+func getDeploySteps(cmdline *Cmdline) []*Step {
+	var state DeployState
 
-	if len(cmdline.updateLambdas) > 0 {
-		updateLambdas(cmdline.baseLambdaPkgs, cmdline.updateLambdas)
-	} else {
-		if !cmdline.deleteAll {
-			authRequired := len(cmdline.authorizationKey) > 0
+	authRequired := len(cmdline.authorizationKey) > 0
 
-			obtainIamRole()
+	steps := []*Step{
+		{
+			name: "roles",
+			run: func() error {
+				createRoles(cmdline.leastPrivilege)
+				return nil
+			},
+		},
+		{
+			name: "tables",
+			run: func() error {
+				createTables()
+				waitTablesActive(cmdline.waitTimeout)
+				if cmdline.pitr {
+					enablePointInTimeRecovery()
+				}
+				return nil
+			},
+		},
+		{
+			name: "lambdas",
+			deps: []string{"roles"},
+			run: func() error {
+				createLambdas(cmdline.baseLambdaPkgs)
+				waitLambdasActive(cmdline.waitTimeout)
+				return createLambdaAliases()
+			},
+		},
+		{
+			name: "stateMachine",
+			deps: []string{"roles", "tables", "lambdas"},
+			run: func() error {
+				state.sfnArn = createStepFunction()
+				if state.sfnArn == nil {
+					return errors.New("no sfn arn")
+				}
+				return nil
+			},
+		},
+		{
+			name: "api",
+			run: func() error {
+				state.apiId = createApi()
+				if state.apiId == nil {
+					var err error
+					state.apiId, err = getApiId()
+					return err
+				}
+				return nil
+			},
+		},
+		{
+			name: "route",
+			deps: []string{"roles", "api", "stateMachine"},
+			run: func() error {
+				state.routeId = mergeRouteWithIntegration(state.apiId, state.sfnArn)
+				if state.routeId == nil {
+					var err error
+					state.routeId, err = getRouteId(state.apiId)
+					return err
+				}
+				return nil
+			},
+		},
+		{
+			name: "stage",
+			deps: []string{"api"},
+			run: func() error {
+				state.stageName = createStage(state.apiId)
+				return nil
+			},
+		},
+		{
+			name: "deployment",
+			deps: []string{"route", "stage"},
+			run: func() error {
+				createDeployment(state.apiId, state.stageName)
+				enableStageAutoDeploy(state.apiId, state.stageName)
+				return nil
+			},
+		},
+	}
 
-			createTables()
+	if cmdline.authMode == AUTH_MODE_JWT {
+		steps = append(steps,
+			&Step{
+				name: "authorizer",
+				deps: []string{"api"},
+				run: func() error {
+					var err error
+					state.authorizerId, err = createOrUpdateJwtAuthorizer(state.apiId)
+					return err
+				},
+			},
+			&Step{
+				name: "routeAuthorizer",
+				deps: []string{"authorizer", "route"},
+				run: func() error {
+					return addJwtAuthorizerToRoutes(state.apiId, state.authorizerId)
+				},
+			})
+	} else if authRequired {
+		routeAuthorizerDeps := []string{"authorizer", "route"}
+
+		// signed requests are checked against the nonces seen so far
+		if cmdline.authMode == AUTH_MODE_HMAC {
+			steps = append(steps, &Step{
+				name: "nonceTable",
+				run: func() error {
+					createNonceTable(cmdline.waitTimeout)
+					return nil
+				},
+			})
+			routeAuthorizerDeps = append(routeAuthorizerDeps, "nonceTable")
+		}
 
-			if authRequired {
-				addAuthorizerLambda()
-				createOrUpdateSecret(&cmdline.authorizationKey)
-			}
+		steps = append(steps,
+			&Step{
+				name: "secret",
+				run: func() error {
+					return createOrUpdateSecret(&cmdline.authorizationKey, cmdline.authMode)
+				},
+			},
+			&Step{
+				name: "authorizer",
+				deps: []string{"roles", "api", "lambdas", "secret"},
+				run: func() error {
+					state.authorizerId = createAuthorizer(state.apiId)
+					if state.authorizerId == nil {
+						var err error
+						state.authorizerId, err = getAuthorizerId(state.apiId)
+						return err
+					}
+					return nil
+				},
+			},
+			&Step{
+				name: "routeAuthorizer",
+				deps: routeAuthorizerDeps,
+				run: func() error {
+					addAuthorizerToRoute(state.authorizerId, state.routeId)
+					return nil
+				},
+			})
+	}
 
-			createLambdas(cmdline.baseLambdaPkgs)
+	return steps
+}
 
-			sfnArn := createStepFunction()
-			if sfnArn == nil {
-				log.Fatalln("no sfn arn - unable to proceed")
+func getTeardownSteps(components map[string]bool, maxWait time.Duration) []*Step {
+	var state DeployState
+	var steps []*Step
+
+	// dependencies on steps which are not part of this teardown are dropped
+	addStep := func(step *Step) {
+		var deps []string
+		for _, dep := range step.deps {
+			for _, other := range steps {
+				if other.name == dep {
+					deps = append(deps, dep)
+					break
+				}
 			}
+		}
 
-			intChan := beginIgnoreInterruption()
+		step.deps = deps
+		steps = append(steps, step)
+	}
 
-			apiId := createApi()
-			if apiId == nil {
-				getApiIdMayFail(&apiId)
-			}
+	if components[COMPONENT_TABLES] || components[COMPONENT_DATA] {
+		var tableNames []*string
+		if components[COMPONENT_TABLES] {
+			tableNames = append(tableNames, getStatusTables()...)
+		}
+		if components[COMPONENT_DATA] {
+			tableNames = append(tableNames, getDataTable())
+		}
 
-			//dependency apiId ok
-			//dependency sfnArn ok
-			routeId := mergeRouteWithIntegration(apiId, sfnArn)
+		addStep(&Step{
+			name: "tables",
+			run: func() error {
+				deleteTables(tableNames)
+				waitTablesDeleted(tableNames, maxWait)
+				return nil
+			},
+		})
+	}
 
-			//dependency apiId ok
-			stageName := createStage(apiId)
+	if components[COMPONENT_LAMBDAS] {
+		addStep(&Step{
+			name: "lambdas",
+			run: func() error {
+				deleteLambdas()
+				return nil
+			},
+		})
+	}
 
-			//dependency apiId ok
-			//dependency stageName ok
-			createDeployment(apiId, stageName)
+	if components[COMPONENT_STATE_MACHINE] {
+		addStep(&Step{
+			name: "stateMachine",
+			run: func() error {
+				state.sfnArn = deleteStepFunction()
+				waitStepFunctionDeleted(state.sfnArn, maxWait)
+				return nil
+			},
+		})
+	}
 
-			//dependency apiId ok
-			//dependency stageName ok
-			enableStageAutoDeploy(apiId, stageName)
+	if components[COMPONENT_API] || components[COMPONENT_AUTHORIZER] {
+		addStep(&Step{
+			name: "api",
+			run: func() error {
+				var err error
+				state.apiId, err = getApiId()
+				return err
+			},
+		})
+	}
 
-			endIgnoreInteruption(intChan)
+	if components[COMPONENT_API] {
+		addStep(&Step{
+			name: "routes",
+			deps: []string{"api"},
+			run: func() error {
+				deleteRoutes(state.apiId)
+				return nil
+			},
+		})
+		addStep(&Step{
+			name: "integrations",
+			deps: []string{"routes"},
+			run: func() error {
+				deleteIntegrations(state.apiId)
+				return nil
+			},
+		})
+		addStep(&Step{
+			name: "apiDeletion",
+			deps: []string{"integrations"},
+			run: func() error {
+				deleteApi(state.apiId)
+				return nil
+			},
+		})
+	}
 
-			if authRequired {
-				//dependency apiId ok
-				authorizerId := createAuthorizer(apiId)
+	if components[COMPONENT_AUTHORIZER] {
+		if !components[COMPONENT_API] {
+			addStep(&Step{
+				name: "authorizer",
+				deps: []string{"api"},
+				run: func() error {
+					deleteAuthorizer(state.apiId)
+					deleteJwtAuthorizer(state.apiId)
+					return nil
+				},
+			})
+		}
 
-				if authorizerId == nil {
-					//dependency apiId ok
-					getAuthorizerIdMayFail(apiId, &authorizerId)
-				}
+		// once the authorizer is gone (along with the api or not)
+		addStep(&Step{
+			name: "authorizerLambda",
+			deps: []string{"authorizer", "apiDeletion"},
+			run: func() error {
+				deleteLambda(authorizerLambda.FunctionName)
+				return nil
+			},
+		})
+
+		addStep(&Step{
+			name: "nonceTable",
+			deps: []string{"authorizer", "apiDeletion"},
+			run: func() error {
+				deleteNonceTable(maxWait)
+				return nil
+			},
+		})
+	}
 
-				if routeId == nil {
-					//dependency apiId ok
-					getRouteIdMayFail(apiId, &routeId)
-				}
+	if components[COMPONENT_ROLES] {
+		addStep(&Step{
+			name: "roles",
+			deps: []string{"lambdas", "stateMachine", "authorizerLambda", "apiDeletion"},
+			run: func() error {
+				deleteRoles()
+				return nil
+			},
+		})
+	}
 
-				//dependency authorizerId ok
-				//dependency routeId ok
-				addAuthorizerToRoute(authorizerId, routeId)
-			}
-		} else {
-			deleteTables()
+	if components[COMPONENT_SECRET] {
+		addStep(&Step{
+			name: "secret",
+			run: func() error {
+				deleteSecret() //try deletion anyway
+				return nil
+			},
+		})
+	} else {
+		log.Println("skipping secret deletion")
+	}
+
+	return steps
+}
 
-			deleteLambdas()
+func main() {
+	if runSubcommandIfAny() {
+		return
+	}
 
-			deleteStepFunction()
+	checkAwsCredentialsFile()
 
-			if cmdline.forceSecretDel {
-				deleteSecret() //try deletion anyway
-			} else {
-				log.Println("skipping secret deletion")
-			}
+	cmdline := parseCmdline()
 
-			intChan := beginIgnoreInterruption()
+	loadAwsConfig()
 
-			var apiId *string
-			getApiIdMayFail(&apiId)
+	switch cmdline.arch {
+	case "":
+	case string(lmbdtypes.ArchitectureX8664), string(lmbdtypes.ArchitectureArm64):
+		setLambdasArch(cmdline.arch)
+	default:
+		log.Fatalf("unknown lambda architecture %s", cmdline.arch)
+	}
 
-			//dependency apiId ok
-			deleteRoutes(apiId)
+	if len(cmdline.updateLambdas) > 0 {
+		updateLambdas(cmdline.baseLambdaPkgs, cmdline.updateLambdas,
+			cmdline.canaryPercent, cmdline.waitTimeout)
+	} else {
+		var steps []*Step
 
-			//dependency apiId ok
-			deleteIntegrations(apiId)
+		if !cmdline.deleteAll {
+			obtainIamRole()
+
+			if cmdline.authMode == AUTH_MODE_JWT {
+				if len(cmdline.authorizationKey) > 0 {
+					log.Fatalln("auth mode jwt needs no key (-a)")
+				}
+
+				setJwtConfig(cmdline.jwtIssuer, cmdline.jwtAudience,
+					cmdline.jwtScopes, cmdline.jwtReadScopes)
+				integration.RequestParameters["Input"] = JWT_INTEGRATION_INPUT
+			} else if len(cmdline.authorizationKey) > 0 {
+				addAuthorizerLambda()
+				setAuthorizerTtl(cmdline.authTtl)
+				setAuthMode(cmdline.authMode)
+			}
+
+			steps = getDeploySteps(&cmdline)
+		} else {
+			steps = getTeardownSteps(getDeleteAllComponents(&cmdline), cmdline.waitTimeout)
+		}
 
-			//dependency apiId ok
-			deleteApi(apiId)
+		// a half-created (or half-deleted) API is hard to recover from,
+		// so do not let CTRL+C stop the program while steps are running
+		intChan := beginIgnoreInterruption()
+		ok := runSteps(steps, cmdline.maxParallelSteps)
+		endIgnoreInteruption(intChan)
 
-			endIgnoreInteruption(intChan)
+		if !ok {
+			os.Exit(1)
 		}
 	}
 }
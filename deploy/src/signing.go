@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*
+ * Signed requests (auth mode hmac)
+ *
+ * Rather than sending its key, which could be replayed if leaked, a producer
+ * signs each request. Headers are:
+ *
+ *   Authorization:         HMAC-SHA256 <clientId>:<signature>
+ *   X-Signature-Timestamp: unix time, seconds
+ *   X-Signature-Nonce:     random, never reused
+ *   X-Content-Sha256:      hex SHA256 of the body
+ *
+ * signature being the hex HMAC-SHA256 of "<timestamp>\n<nonce>\n<body sha256>"
+ * keyed by the hex SHA256 of the client key (the hash the registry holds, see
+ * keys.go). The authorizer rejects timestamps out of its max clock skew and
+ * nonces already seen (nonceTable, see config.go).
+ *
+ * HTTP API authorizers never get the request body: X-Content-Sha256 is passed
+ * along to the state machine (HMAC_INTEGRATION_INPUT) and the validate lambda
+ * rejects bodies not matching it. The body signed is the compact JSON object
+ * {"tuple": ...} as encoding/json writes it (what the injector sends), since
+ * the lambda recomputes the sha256 of the body out of the tuple it gets.
+ * Signing keys are the registry hashes, the secret itself is enough to sign
+ * requests
+ */
+
+const (
+	AUTH_MODE_KEY  = "key"
+	AUTH_MODE_HMAC = "hmac"
+)
+
+var authModes = []string{AUTH_MODE_KEY, AUTH_MODE_HMAC, AUTH_MODE_JWT}
+
+// State machine input of authenticated requests (see config.go)
+func getAuthIntegrationInput(mode string) string {
+	if mode == AUTH_MODE_HMAC {
+		return HMAC_INTEGRATION_INPUT
+	}
+
+	return AUTH_INTEGRATION_INPUT
+}
+
+// Check auth mode and configure the authorizer accordingly
+func setAuthMode(mode string) {
+	switch mode {
+	case AUTH_MODE_KEY:
+	case AUTH_MODE_HMAC:
+		// a cached result would let a replayed request (same nonce) in
+		if *authorizer.AuthorizerResultTtlInSeconds > 0 {
+			log.Fatalln("authorization results caching (ttl) must be 0 with signed requests")
+		}
+
+		authorizer.IdentitySource = hmacIdentitySource
+		integration.RequestParameters["Input"] = HMAC_INTEGRATION_INPUT
+	case AUTH_MODE_JWT:
+		// see jwt.go
+	default:
+		log.Fatalf("unknown auth mode %s (expected one of: %s)",
+			mode, strings.Join(authModes, ", "))
+	}
+}
+
+func createNonceTable(maxWait time.Duration) {
+	opOut, err := svc.dynamodb.CreateTable(dflCtx(), &nonceTable)
+	if err != nil {
+		var inUse *ddbtypes.ResourceInUseException
+		if !errors.As(err, &inUse) {
+			log.Printf("unable to create dynamodb table: %v\n", err)
+			return
+		}
+
+		log.Printf("existing table %s\n", *nonceTable.TableName)
+	} else {
+		log.Printf("create table %s, arn %s, status %s\n",
+			*opOut.TableDescription.TableName,
+			*opOut.TableDescription.TableArn,
+			opOut.TableDescription.TableStatus)
+	}
+
+	waitTableActive(nonceTable.TableName, maxWait)
+
+	uttli := dynamodb.UpdateTimeToLiveInput{
+		TableName: nonceTable.TableName,
+		TimeToLiveSpecification: &ddbtypes.TimeToLiveSpecification{
+			AttributeName: aws.String(NONCE_TTL_ATTRIBUTE),
+			Enabled:       aws.Bool(true),
+		},
+	}
+
+	// fails if already enabled, which is fine
+	if _, err := svc.dynamodb.UpdateTimeToLive(dflCtx(), &uttli); err != nil {
+		log.Printf("unable to enable ttl on table %s: %v\n", *nonceTable.TableName, err)
+	} else {
+		log.Printf("enable ttl on table %s, attribute: %s\n",
+			*nonceTable.TableName, NONCE_TTL_ATTRIBUTE)
+	}
+}
+
+// Nonce table exists only if signed requests have ever been enabled
+func deleteNonceTable(maxWait time.Duration) {
+	dti := dynamodb.DescribeTableInput{TableName: nonceTable.TableName}
+	if _, err := svc.dynamodb.DescribeTable(dflCtx(), &dti); err != nil {
+		var notFound *ddbtypes.ResourceNotFoundException
+		if !errors.As(err, &notFound) {
+			log.Printf("unable to describe table %s: %v\n", *nonceTable.TableName, err)
+		}
+		return
+	}
+
+	tableNames := []*string{nonceTable.TableName}
+	deleteTables(tableNames)
+	waitTablesDeleted(tableNames, maxWait)
+}
+
+// Auth mode of the deployed authorizer, as stored in the key registry
+func getAuthMode() (string, error) {
+	registry, err := getKeyRegistry()
+	if err != nil {
+		return "", err
+	}
+
+	if len(registry.Mode) == 0 {
+		return AUTH_MODE_KEY, nil
+	}
+
+	return registry.Mode, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewayv2"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+/*
+ * Deployment status (subcommand status)
+ *
+ * Describes what is currently deployed: API endpoint, ARNs, lambdas (and the
+ * versions their alias routes to), tables item counts and authorizer state.
+ * Missing resources are simply left empty.
+ *
+ * Status may also be written as JSON to an outputs file: the injector reads
+ * OUTPUTS_FILE_RELNAME (relative to user home, i.e. its default cachedir)
+ * automatically, so that there is no need to copy the API endpoint around
+ */
+
+const OUTPUTS_FILE_RELNAME = ".sdcc_dinj_cache/deploy_outputs.json"
+
+type LambdaStatus struct {
+	Name          string `json:"name"`
+	Arn           string `json:"arn"`
+	State         string `json:"state"`
+	Architecture  string `json:"architecture"`
+	MemorySize    int32  `json:"memorySize"`
+	AliasVersion  string `json:"aliasVersion,omitempty"`
+	CanaryVersion string `json:"canaryVersion,omitempty"`
+}
+
+type TableStatus struct {
+	Name      string `json:"name"`
+	Arn       string `json:"arn"`
+	Status    string `json:"status"`
+	ItemCount int64  `json:"itemCount"`
+	Exact     bool   `json:"exact"` // count by scan, otherwise updated every ~6 hours
+}
+
+type AuthorizerStatus struct {
+	Enabled      bool   `json:"enabled"`
+	AuthorizerId string `json:"authorizerId,omitempty"`
+	SecretArn    string `json:"secretArn,omitempty"`
+	Mode         string `json:"mode,omitempty"`   // see signing.go and jwt.go
+	Issuer       string `json:"issuer,omitempty"` // jwt mode only
+}
+
+type DeployStatus struct {
+	Region          string           `json:"region"`
+	ApiId           string           `json:"apiId,omitempty"`
+	ApiEndpoint     string           `json:"apiEndpoint,omitempty"`
+	StateMachineArn string           `json:"stateMachineArn,omitempty"`
+	Lambdas         []LambdaStatus   `json:"lambdas"`
+	Tables          []TableStatus    `json:"tables"`
+	Authorizer      AuthorizerStatus `json:"authorizer"`
+	Time            time.Time        `json:"time"`
+}
+
+func getLambdaStatus(name *string) (*LambdaStatus, error) {
+	gfi := lambda.GetFunctionInput{FunctionName: name}
+	gfOut, err := svc.lambda.GetFunction(dflCtx(), &gfi)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := gfOut.Configuration
+	lambdaStatus := LambdaStatus{
+		Name:       *conf.FunctionName,
+		Arn:        *conf.FunctionArn,
+		State:      string(conf.State),
+		MemorySize: aws.ToInt32(conf.MemorySize),
+	}
+	if len(conf.Architectures) > 0 {
+		lambdaStatus.Architecture = string(conf.Architectures[0])
+	}
+
+	if gaOut, err := getAlias(name); err == nil {
+		lambdaStatus.AliasVersion = *gaOut.FunctionVersion
+		lambdaStatus.CanaryVersion = aws.ToString(getCanaryVersion(gaOut))
+	}
+
+	return &lambdaStatus, nil
+}
+
+// Exact number of items (Select COUNT scan, paginated)
+func countItems(table *string) (int64, error) {
+	si := dynamodb.ScanInput{
+		TableName: table,
+		Select:    ddbtypes.SelectCount,
+	}
+
+	var count int64
+
+	for {
+		sOut, err := svc.dynamodb.Scan(dflCtx(), &si)
+		if err != nil {
+			return 0, err
+		}
+
+		count += int64(sOut.Count)
+
+		si.ExclusiveStartKey = sOut.LastEvaluatedKey
+		if len(si.ExclusiveStartKey) == 0 {
+			break
+		}
+	}
+
+	return count, nil
+}
+
+func getTableStatus(table *string, exact bool) (*TableStatus, error) {
+	dti := dynamodb.DescribeTableInput{TableName: table}
+	dtOut, err := svc.dynamodb.DescribeTable(dflCtx(), &dti)
+	if err != nil {
+		return nil, err
+	}
+
+	tableStatus := TableStatus{
+		Name:      *dtOut.Table.TableName,
+		Arn:       *dtOut.Table.TableArn,
+		Status:    string(dtOut.Table.TableStatus),
+		ItemCount: aws.ToInt64(dtOut.Table.ItemCount),
+	}
+
+	if exact {
+		count, err := countItems(table)
+		if err != nil {
+			log.Printf("unable to count items of table %s: %v\n", *table, err)
+		} else {
+			tableStatus.ItemCount = count
+			tableStatus.Exact = true
+		}
+	}
+
+	return &tableStatus, nil
+}
+
+func getAuthorizerStatus(apiId *string) AuthorizerStatus {
+	var authorizerStatus AuthorizerStatus
+
+	if apiId != nil {
+		if authorizerId, err := getAuthorizerId(apiId); err == nil {
+			authorizerStatus.Enabled = true
+			authorizerStatus.AuthorizerId = *authorizerId
+		} else if authorizerId, err := getAuthorizerIdByName(apiId, jwtAuthorizer.Name); err == nil {
+			authorizerStatus.Enabled = true
+			authorizerStatus.AuthorizerId = *authorizerId
+			authorizerStatus.Mode = AUTH_MODE_JWT
+
+			gai := apigatewayv2.GetAuthorizerInput{ApiId: apiId, AuthorizerId: authorizerId}
+			if gaOut, err := svc.apigateway.GetAuthorizer(dflCtx(), &gai); err == nil &&
+				gaOut.JwtConfiguration != nil {
+				authorizerStatus.Issuer = aws.ToString(gaOut.JwtConfiguration.Issuer)
+			}
+
+			return authorizerStatus
+		}
+	}
+
+	dsi := secretsmanager.DescribeSecretInput{SecretId: secret.Name}
+	dsOut, err := svc.secretsmanager.DescribeSecret(dflCtx(), &dsi)
+	if err == nil && dsOut.DeletedDate == nil {
+		authorizerStatus.SecretArn = *dsOut.ARN
+
+		if mode, err := getAuthMode(); err != nil {
+			log.Printf("unable to get auth mode: %v\n", err)
+		} else {
+			authorizerStatus.Mode = mode
+		}
+	}
+
+	return authorizerStatus
+}
+
+func getDeployStatus(exactCounts bool) DeployStatus {
+	status := DeployStatus{
+		Region:  AWS_REGION,
+		Lambdas: []LambdaStatus{},
+		Tables:  []TableStatus{},
+		Time:    time.Now().UTC(),
+	}
+
+	apiId, err := getApiId()
+	if err != nil {
+		log.Printf("unable to find api %s: %v\n", *api.Name, err)
+	} else {
+		status.ApiId = *apiId
+
+		gaOut, err := svc.apigateway.GetApi(dflCtx(), &apigatewayv2.GetApiInput{ApiId: apiId})
+		if err != nil {
+			log.Printf("unable to get api %s: %v\n", *apiId, err)
+		} else {
+			status.ApiEndpoint = aws.ToString(gaOut.ApiEndpoint)
+		}
+	}
+
+	if sfnArn, err := getStepFunctionArn(); err != nil {
+		log.Printf("unable to find sfn %s: %v\n", *stateMachine.Name, err)
+	} else {
+		status.StateMachineArn = *sfnArn
+	}
+
+	for _, lmbd := range append(lambdas, authorizerLambda) {
+		lambdaStatus, err := getLambdaStatus(lmbd.FunctionName)
+		if err != nil {
+			log.Printf("unable to get lambda %s: %v\n", *lmbd.FunctionName, err)
+			continue
+		}
+
+		status.Lambdas = append(status.Lambdas, *lambdaStatus)
+	}
+
+	for _, table := range tables {
+		tableStatus, err := getTableStatus(table.TableName, exactCounts)
+		if err != nil {
+			log.Printf("unable to describe table %s: %v\n", *table.TableName, err)
+			continue
+		}
+
+		status.Tables = append(status.Tables, *tableStatus)
+	}
+
+	status.Authorizer = getAuthorizerStatus(apiId)
+
+	return status
+}
+
+func printStatusText(out io.Writer, status *DeployStatus) {
+	orNone := func(str string) string {
+		if len(str) == 0 {
+			return "(none)"
+		}
+		return str
+	}
+
+	fmt.Fprintf(out, "region:        %s\n", status.Region)
+	fmt.Fprintf(out, "api endpoint:  %s\n", orNone(status.ApiEndpoint))
+	fmt.Fprintf(out, "api id:        %s\n", orNone(status.ApiId))
+	fmt.Fprintf(out, "state machine: %s\n", orNone(status.StateMachineArn))
+
+	fmt.Fprintln(out, "\nlambdas:")
+	for _, l := range status.Lambdas {
+		routing := "alias -> " + orNone(l.AliasVersion)
+		if len(l.CanaryVersion) > 0 {
+			routing += ", canary -> " + l.CanaryVersion
+		}
+
+		fmt.Fprintf(out, "  %-20s %-8s %-7s %5d MB  %s\n    %s\n",
+			l.Name, l.State, l.Architecture, l.MemorySize, routing, l.Arn)
+	}
+
+	fmt.Fprintln(out, "\ntables:")
+	for _, t := range status.Tables {
+		count := fmt.Sprintf("~%d", t.ItemCount)
+		if t.Exact {
+			count = fmt.Sprintf("%d", t.ItemCount)
+		}
+
+		fmt.Fprintf(out, "  %-22s %-8s %12s items\n    %s\n", t.Name, t.Status, count, t.Arn)
+	}
+
+	fmt.Fprintln(out, "\nauthorizer:")
+	fmt.Fprintf(out, "  enabled:       %t\n", status.Authorizer.Enabled)
+	fmt.Fprintf(out, "  authorizer id: %s\n", orNone(status.Authorizer.AuthorizerId))
+	fmt.Fprintf(out, "  secret:        %s\n", orNone(status.Authorizer.SecretArn))
+	fmt.Fprintf(out, "  mode:          %s\n", orNone(status.Authorizer.Mode))
+	if len(status.Authorizer.Issuer) > 0 {
+		fmt.Fprintf(out, "  issuer:        %s\n", status.Authorizer.Issuer)
+	}
+}
+
+func writeOutputsFile(path string, status *DeployStatus) error {
+	statusBytes, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(statusBytes, '\n'), 0644)
+}
+
+func getDefaultOutputsFile() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("unable to get user home: %v", err)
+	}
+
+	return filepath.Join(homeDir, OUTPUTS_FILE_RELNAME)
+}
+
+func statusMain(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+
+	format := fs.String("format", "text", "Output format: text or json")
+	exact := fs.Bool("exact", false,
+		"Count table items by scanning them (slow, consumes read capacity)")
+	output := fs.String("o", "", "Also write status (JSON) to this outputs file")
+	save := fs.Bool("save", false,
+		"Also write status (JSON) to the outputs file read by the injector (~/"+
+			OUTPUTS_FILE_RELNAME+")")
+
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		log.Fatalf("unknown status format %s", *format)
+	}
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	status := getDeployStatus(*exact)
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+	} else {
+		printStatusText(os.Stdout, &status)
+	}
+
+	var outputsFiles []string
+	if len(*output) > 0 {
+		outputsFiles = append(outputsFiles, *output)
+	}
+	if *save {
+		outputsFiles = append(outputsFiles, getDefaultOutputsFile())
+	}
+
+	for _, path := range outputsFiles {
+		if err := writeOutputsFile(path, &status); err != nil {
+			log.Fatalf("unable to write outputs file %s: %v", path, err)
+		}
+
+		log.Printf("write outputs file %s\n", path)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Deployment steps graph
+ *
+ * Each step names the steps it depends on, a step is run as soon as all of
+ * its dependencies are done, so independent steps (e.g. tables, lambdas and
+ * the secret) run concurrently, at most maxParallel at a time (option -j)
+ *
+ * If a step fails (its run function returns an error), whatever depends on it,
+ * directly or not, is skipped, while all of the other steps are still run
+ * (same policy as before: program will *NOT* terminate)
+ */
+
+type StepStatus string
+
+const (
+	StepPending StepStatus = "pending"
+	StepDone    StepStatus = "done"
+	StepFailed  StepStatus = "failed"
+	StepSkipped StepStatus = "skipped"
+)
+
+type Step struct {
+	name string
+	deps []string
+	run  func() error
+
+	status  StepStatus
+	err     error
+	elapsed time.Duration
+	done    chan struct{}
+}
+
+// Check that all of the dependencies exist and that there are no cycles
+// (Kahn's algorithm), running such a graph would just hang forever
+func checkSteps(steps []*Step) error {
+	byName := make(map[string]*Step)
+	for _, step := range steps {
+		if _, dup := byName[step.name]; dup {
+			return fmt.Errorf("duplicated step %s", step.name)
+		}
+		byName[step.name] = step
+	}
+
+	inDegree := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, step := range steps {
+		for _, dep := range step.deps {
+			if _, ok := byName[dep]; !ok {
+				return fmt.Errorf("step %s depends on unknown step %s", step.name, dep)
+			}
+			dependents[dep] = append(dependents[dep], step.name)
+		}
+		inDegree[step.name] = len(step.deps)
+	}
+
+	var ready []string
+	for _, step := range steps {
+		if inDegree[step.name] == 0 {
+			ready = append(ready, step.name)
+		}
+	}
+
+	visited := 0
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		visited++
+
+		for _, dependent := range dependents[name] {
+			inDegree[dependent]--
+			if inDegree[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if visited != len(steps) {
+		return errors.New("steps have circular dependencies")
+	}
+
+	return nil
+}
+
+// Run the whole steps graph, returns true if every step is done
+func runSteps(steps []*Step, maxParallel int) bool {
+	if err := checkSteps(steps); err != nil {
+		log.Fatalf("invalid deployment steps: %v", err)
+	}
+
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+
+	byName := make(map[string]*Step)
+	for _, step := range steps {
+		step.status = StepPending
+		step.done = make(chan struct{})
+		byName[step.name] = step
+	}
+
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+
+	for _, step := range steps {
+		wg.Add(1)
+		go func(step *Step) {
+			defer wg.Done()
+			defer close(step.done)
+
+			// dependency status is safe to read after its done chan is closed
+			for _, dep := range step.deps {
+				depStep := byName[dep]
+				<-depStep.done
+				if depStep.status != StepDone {
+					step.status = StepSkipped
+					step.err = fmt.Errorf("dependency %s %s", dep, depStep.status)
+				}
+			}
+
+			if step.status == StepSkipped {
+				log.Printf("step %s skipped (%v)\n", step.name, step.err)
+				return
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			log.Printf("step %s running\n", step.name)
+
+			begin := time.Now()
+			step.err = step.run()
+			step.elapsed = time.Since(begin)
+
+			if step.err != nil {
+				step.status = StepFailed
+				log.Printf("step %s failed after %v: %v\n",
+					step.name, step.elapsed.Round(time.Millisecond), step.err)
+			} else {
+				step.status = StepDone
+				log.Printf("step %s done in %v\n",
+					step.name, step.elapsed.Round(time.Millisecond))
+			}
+		}(step)
+	}
+
+	wg.Wait()
+
+	return printStepsSummary(steps)
+}
+
+func printStepsSummary(steps []*Step) bool {
+	allDone := true
+
+	log.Println("steps summary:")
+	for _, step := range steps {
+		deps := "-"
+		if len(step.deps) > 0 {
+			deps = strings.Join(step.deps, ",")
+		}
+
+		log.Printf("\t%-20s %-8s %10v  (after: %s)\n",
+			step.name, step.status, step.elapsed.Round(time.Millisecond), deps)
+
+		if step.status != StepDone {
+			allDone = false
+		}
+	}
+
+	return allDone
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lmbdtypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+/*
+ * Lambda versions, aliases and canary rollouts
+ *
+ * The state machine (and the authorizer) never invoke $LATEST, but the
+ * LAMBDA_ALIAS alias of each lambda (see config.go). Updating a lambda (-u)
+ * publishes a new version and then either:
+ *
+ *  - moves the alias to the new version (default)
+ *  - keeps the alias on the current (stable) version while routing only a
+ *    percentage of invocations to the new one (canary, option -c)
+ *
+ * A canary is then either promoted ("deploy promote") or rolled back
+ * ("deploy rollback"), the latter may also watch failure rates in status
+ * tables and roll back only if they spike ("deploy rollback -auto")
+ */
+
+func qualifiedLambdaName(name *string) string {
+	return *name + ":" + LAMBDA_ALIAS
+}
+
+func getAlias(name *string) (*lambda.GetAliasOutput, error) {
+	gai := lambda.GetAliasInput{
+		FunctionName: name,
+		Name:         aws.String(LAMBDA_ALIAS),
+	}
+
+	return svc.lambda.GetAlias(dflCtx(), &gai)
+}
+
+func publishVersion(name *string) (*string, error) {
+	pvi := lambda.PublishVersionInput{FunctionName: name}
+	pvOut, err := svc.lambda.PublishVersion(dflCtx(), &pvi)
+	if err != nil {
+		return nil, err
+	}
+
+	return pvOut.Version, nil
+}
+
+func getEnvVariables(env *lmbdtypes.EnvironmentResponse) map[string]string {
+	if env == nil {
+		return nil
+	}
+
+	return env.Variables
+}
+
+// Whether the version the alias routes to has the very same code and
+// configuration as $LATEST, i.e. there is nothing to publish
+func isLatestRouted(name *string) bool {
+	gaOut, err := getAlias(name)
+	if err != nil {
+		return false
+	}
+
+	gfci := lambda.GetFunctionConfigurationInput{FunctionName: name}
+	latest, err := svc.lambda.GetFunctionConfiguration(dflCtx(), &gfci)
+	if err != nil {
+		return false
+	}
+
+	gfci.Qualifier = gaOut.FunctionVersion
+	routed, err := svc.lambda.GetFunctionConfiguration(dflCtx(), &gfci)
+	if err != nil {
+		return false
+	}
+
+	return aws.ToString(latest.CodeSha256) == aws.ToString(routed.CodeSha256) &&
+		aws.ToInt32(latest.MemorySize) == aws.ToInt32(routed.MemorySize) &&
+		aws.ToInt32(latest.Timeout) == aws.ToInt32(routed.Timeout) &&
+		maps.Equal(getEnvVariables(latest.Environment), getEnvVariables(routed.Environment))
+}
+
+// Point alias to version, weights may be nil (no additional version)
+func routeAlias(name *string, version *string, weights map[string]float64) error {
+	if weights == nil {
+		// an empty map is needed to drop an existing routing config
+		weights = map[string]float64{}
+	}
+
+	uai := lambda.UpdateAliasInput{
+		FunctionName:    name,
+		Name:            aws.String(LAMBDA_ALIAS),
+		FunctionVersion: version,
+		RoutingConfig: &lmbdtypes.AliasRoutingConfiguration{
+			AdditionalVersionWeights: weights,
+		},
+	}
+
+	_, err := svc.lambda.UpdateAlias(dflCtx(), &uai)
+	return err
+}
+
+// Publish a version and create the alias if it does not exist yet
+func createLambdaAlias(name *string) error {
+	gaOut, err := getAlias(name)
+	if err == nil {
+		log.Printf("existing alias %s, version: %s\n",
+			qualifiedLambdaName(name), *gaOut.FunctionVersion)
+		return nil
+	}
+
+	var notFound *lmbdtypes.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return err
+	}
+
+	version, err := publishVersion(name)
+	if err != nil {
+		return err
+	}
+
+	cai := lambda.CreateAliasInput{
+		FunctionName:    name,
+		Name:            aws.String(LAMBDA_ALIAS),
+		FunctionVersion: version,
+	}
+	caOut, err := svc.lambda.CreateAlias(dflCtx(), &cai)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("create alias %s, version: %s, arn: %s\n",
+		qualifiedLambdaName(name), *caOut.FunctionVersion, *caOut.AliasArn)
+
+	return nil
+}
+
+// Aliases are referenced by the state machine: if one of them cannot
+// be created there is no point in creating the state machine
+func createLambdaAliases() error {
+	var failed []string
+
+	for _, lmbd := range lambdas {
+		if err := createLambdaAlias(lmbd.FunctionName); err != nil {
+			log.Printf("unable to create alias for lambda %s: %v\n", *lmbd.FunctionName, err)
+			failed = append(failed, *lmbd.FunctionName)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("no alias for lambdas %v", failed)
+	}
+
+	return nil
+}
+
+// Called after $LATEST code update: publish it and route the alias to it,
+// entirely or canaryPercent% of invocations
+func publishAndRouteLambda(name *string, canaryPercent int, maxWait time.Duration) {
+	// a version can be published only after the code update completed
+	waitLambdaUpdated(name, maxWait)
+
+	version, err := publishVersion(name)
+	if err != nil {
+		log.Printf("unable to publish version for lambda %s: %v\n", *name, err)
+		return
+	}
+
+	gaOut, err := getAlias(name)
+	if err != nil {
+		// deployed before aliases existed, create it straight away
+		if err := createLambdaAlias(name); err != nil {
+			log.Printf("unable to create alias for lambda %s: %v\n", *name, err)
+		}
+		return
+	}
+
+	stable := gaOut.FunctionVersion
+
+	if *stable == *version {
+		log.Printf("alias %s already routes to version %s (code unchanged?)\n",
+			qualifiedLambdaName(name), *version)
+		return
+	}
+
+	if canaryPercent <= 0 || canaryPercent >= 100 {
+		if err := routeAlias(name, version, nil); err != nil {
+			log.Printf("unable to update alias %s: %v\n", qualifiedLambdaName(name), err)
+		} else {
+			log.Printf("update alias %s, version: %s (was %s)\n",
+				qualifiedLambdaName(name), *version, *stable)
+		}
+		return
+	}
+
+	weights := map[string]float64{*version: float64(canaryPercent) / 100}
+	if err := routeAlias(name, stable, weights); err != nil {
+		log.Printf("unable to update alias %s: %v\n", qualifiedLambdaName(name), err)
+	} else {
+		log.Printf("update alias %s, version: %s, canary version: %s (%d%%)\n",
+			qualifiedLambdaName(name), *stable, *version, canaryPercent)
+	}
+}
+
+// Get the canary version (if any) the alias is routing to
+func getCanaryVersion(gaOut *lambda.GetAliasOutput) *string {
+	if gaOut.RoutingConfig == nil {
+		return nil
+	}
+
+	for version := range gaOut.RoutingConfig.AdditionalVersionWeights {
+		return aws.String(version)
+	}
+
+	return nil
+}
+
+// Move alias entirely to canary version
+func promoteLambda(name *string) {
+	gaOut, err := getAlias(name)
+	if err != nil {
+		log.Printf("unable to get alias %s: %v\n", qualifiedLambdaName(name), err)
+		return
+	}
+
+	canary := getCanaryVersion(gaOut)
+	if canary == nil {
+		log.Printf("no canary for alias %s, version: %s\n",
+			qualifiedLambdaName(name), *gaOut.FunctionVersion)
+		return
+	}
+
+	if err := routeAlias(name, canary, nil); err != nil {
+		log.Printf("unable to promote alias %s: %v\n", qualifiedLambdaName(name), err)
+	} else {
+		log.Printf("promote alias %s, version: %s (was %s)\n",
+			qualifiedLambdaName(name), *canary, *gaOut.FunctionVersion)
+	}
+}
+
+// Find the highest published version lower than the given one
+func getPreviousVersion(name *string, current *string) (*string, error) {
+	cur, err := strconv.Atoi(*current)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+
+	lvi := lambda.ListVersionsByFunctionInput{FunctionName: name}
+	for {
+		lvOut, err := svc.lambda.ListVersionsByFunction(dflCtx(), &lvi)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fc := range lvOut.Versions {
+			// $LATEST is not a number
+			if v, err := strconv.Atoi(*fc.Version); err == nil && v < cur {
+				versions = append(versions, v)
+			}
+		}
+
+		lvi.Marker = lvOut.NextMarker
+		if lvi.Marker == nil {
+			break
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, errors.New("no previous version")
+	}
+
+	sort.Ints(versions)
+	return aws.String(strconv.Itoa(versions[len(versions)-1])), nil
+}
+
+// Drop canary (alias stays on stable version) or, if there is no
+// canary, move alias back to the previous published version
+func rollbackLambda(name *string) {
+	gaOut, err := getAlias(name)
+	if err != nil {
+		log.Printf("unable to get alias %s: %v\n", qualifiedLambdaName(name), err)
+		return
+	}
+
+	target := gaOut.FunctionVersion
+
+	if canary := getCanaryVersion(gaOut); canary != nil {
+		log.Printf("dropping canary version %s for alias %s\n",
+			*canary, qualifiedLambdaName(name))
+	} else {
+		target, err = getPreviousVersion(name, gaOut.FunctionVersion)
+		if err != nil {
+			log.Printf("unable to rollback alias %s, version: %s: %v\n",
+				qualifiedLambdaName(name), *gaOut.FunctionVersion, err)
+			return
+		}
+	}
+
+	if err := routeAlias(name, target, nil); err != nil {
+		log.Printf("unable to rollback alias %s: %v\n", qualifiedLambdaName(name), err)
+	} else {
+		log.Printf("rollback alias %s, version: %s (was %s)\n",
+			qualifiedLambdaName(name), *target, *gaOut.FunctionVersion)
+	}
+}
+
+/*
+ * Failure rates in status tables: any item with StatusReason different
+ * from 0 has been flagged by flag*Failed lambdas. Items tell when they were
+ * created (CreatedAt, unix time) and by which version of the lambda of their
+ * phase (LambdaVersion, see ../../lambdas/dyndbutils), so that only the
+ * tuples a canary version took care of are accounted for
+ */
+
+type TableFailures struct {
+	total  int32
+	failed int32
+}
+
+// Items created since, by version (any version if nil)
+func countTableFailures(table *string, since int64, version *string) (TableFailures, error) {
+	var tf TableFailures
+
+	si := dynamodb.ScanInput{
+		TableName:            table,
+		ProjectionExpression: aws.String("StatusReason"),
+		FilterExpression:     aws.String("CreatedAt >= :since"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":since": &ddbtypes.AttributeValueMemberN{Value: strconv.FormatInt(since, 10)},
+		},
+	}
+	if version != nil {
+		si.FilterExpression = aws.String(*si.FilterExpression + " AND LambdaVersion = :version")
+		si.ExpressionAttributeValues[":version"] = &ddbtypes.AttributeValueMemberS{Value: *version}
+	}
+
+	for {
+		sOut, err := svc.dynamodb.Scan(dflCtx(), &si)
+		if err != nil {
+			return tf, err
+		}
+
+		for _, item := range sOut.Items {
+			tf.total++
+
+			reason, ok := item["StatusReason"].(*ddbtypes.AttributeValueMemberN)
+			if ok && reason.Value != "0" {
+				tf.failed++
+			}
+		}
+
+		si.ExclusiveStartKey = sOut.LastEvaluatedKey
+		if len(si.ExclusiveStartKey) == 0 {
+			break
+		}
+	}
+
+	return tf, nil
+}
+
+// status tables only (see config.go), the final one has no StatusReason
+func getStatusTables() []*string {
+	return []*string{
+		tables[0].TableName, //validationStatus
+		tables[1].TableName, //transformationStatus
+		tables[2].TableName, //storeStatus
+	}
+}
+
+// Lambdas of the phases of status tables, in the same order
+func getStatusTableLambdas() []*string {
+	return []*string{
+		lambdas[0].FunctionName, //validate
+		lambdas[1].FunctionName, //transform
+		lambdas[2].FunctionName, //store
+	}
+}
+
+// Watch status tables for a while, returns true if failure rate of tuples
+// that went through the pipeline in the meantime exceeds maxRate in any table.
+// Only tuples of the canary version of the lambda of each phase count, if
+// any, all of them otherwise (no canary: the new version takes them all)
+func failureRateSpiked(window time.Duration, maxRate float64, minSamples int32) (bool, error) {
+	since := time.Now().Unix()
+
+	log.Printf("watching failure rates for %v (max rate: %.2f)\n", window, maxRate)
+	time.Sleep(window)
+
+	spiked := false
+
+	statusLambdas := getStatusTableLambdas()
+	for i, table := range getStatusTables() {
+		var canary *string
+		if gaOut, err := getAlias(statusLambdas[i]); err == nil {
+			canary = getCanaryVersion(gaOut)
+		}
+
+		tf, err := countTableFailures(table, since, canary)
+		if err != nil {
+			return false, err
+		}
+
+		of := "any version"
+		if canary != nil {
+			of = "canary version " + *canary
+		}
+
+		if tf.total < minSamples {
+			log.Printf("\ttable %s: %d new tuples (%s), not enough samples (min %d)\n",
+				*table, tf.total, of, minSamples)
+			continue
+		}
+
+		rate := float64(tf.failed) / float64(tf.total)
+		log.Printf("\ttable %s: %d new tuples (%s), %d failed, rate: %.2f\n",
+			*table, tf.total, of, tf.failed, rate)
+
+		if rate > maxRate {
+			spiked = true
+		}
+	}
+
+	return spiked, nil
+}
+
+// deploy promote [options]
+func promoteMain(args []string) {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+
+	csl := fs.String("l", "all", "Comma-separated lambdas to promote canary of, or all")
+
+	fs.Parse(args)
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	for _, name := range getLambdaNames(*csl) {
+		promoteLambda(aws.String(name))
+	}
+}
+
+// deploy rollback [options]
+func rollbackMain(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+
+	csl := fs.String("l", "all", "Comma-separated lambdas to rollback, or all")
+	auto := fs.Bool("auto", false,
+		"Rollback only if failure rate in status tables spikes during -window")
+	window := fs.Duration("window", 5*time.Minute,
+		"How long to watch status tables for (with -auto)")
+	maxRate := fs.Float64("max-error-rate", 0.3,
+		"Max failure rate (0..1) of new tuples in any status table (with -auto)")
+	minSamples := fs.Int("min-samples", 20,
+		"Min number of new tuples in a status table to consider its rate (with -auto)")
+
+	fs.Parse(args)
+
+	checkAwsCredentialsFile()
+	loadAwsConfig()
+
+	if *auto {
+		spiked, err := failureRateSpiked(*window, *maxRate, int32(*minSamples))
+		if err != nil {
+			log.Fatalf("unable to watch failure rates: %v", err)
+		}
+
+		if !spiked {
+			log.Println("failure rates ok, nothing to rollback")
+			return
+		}
+
+		log.Println("failure rate spiked, rolling back")
+	}
+
+	for _, name := range getLambdaNames(*csl) {
+		rollbackLambda(aws.String(name))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+)
+
+/*
+ * AWS wait for resources
+ *
+ * Tables are CREATING and lambdas are Pending right after their creation
+ * call returns, so whatever depends on them (state machine, API) must wait
+ * for them to become ACTIVE. The same holds on teardown: a table stays
+ * DELETING (and a state machine stays DELETING) for a while, and a new
+ * deployment issued in the meantime would fail with "resource in use".
+ *
+ * Each resource is waited for at most maxWait (option -w), 0 disables waiting.
+ * As for the other steps, if waiting fails, program will *NOT* terminate
+ */
+
+// Polling delays for the state machine, which has no SDK-provided waiter
+const SFN_WAIT_MIN_DELAY = 2 * time.Second
+const SFN_WAIT_MAX_DELAY = 10 * time.Second
+
+// Wait for all of the DynamoDB tables (see config.go) to become ACTIVE
+func waitTablesActive(maxWait time.Duration) {
+	if maxWait <= 0 {
+		return
+	}
+
+	for _, table := range tables {
+		waitTableActive(table.TableName, maxWait)
+	}
+}
+
+func waitTableActive(tableName *string, maxWait time.Duration) {
+	if maxWait <= 0 {
+		return
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(svc.dynamodb,
+		func(o *dynamodb.TableExistsWaiterOptions) {
+			dflRetryable := o.Retryable
+			o.Retryable = func(ctx context.Context, in *dynamodb.DescribeTableInput,
+				out *dynamodb.DescribeTableOutput, err error) (bool, error) {
+				if out != nil && out.Table != nil {
+					log.Printf("\twaiting for table %s, status: %s\n",
+						*in.TableName, out.Table.TableStatus)
+				}
+				return dflRetryable(ctx, in, out, err)
+			}
+		})
+
+	dti := dynamodb.DescribeTableInput{TableName: tableName}
+	err := waiter.Wait(dflCtx(), &dti, maxWait)
+	if err != nil {
+		log.Printf("unable to wait for table %s: %v\n", *tableName, err)
+	} else {
+		log.Printf("wait table %s, status: %s\n",
+			*tableName, ddbtypes.TableStatusActive)
+	}
+}
+
+// Wait for all of the DynamoDB tables (see config.go) to be gone
+func waitTablesDeleted(tableNames []*string, maxWait time.Duration) {
+	if maxWait <= 0 {
+		return
+	}
+
+	for _, tableName := range tableNames {
+		waiter := dynamodb.NewTableNotExistsWaiter(svc.dynamodb,
+			func(o *dynamodb.TableNotExistsWaiterOptions) {
+				dflRetryable := o.Retryable
+				o.Retryable = func(ctx context.Context, in *dynamodb.DescribeTableInput,
+					out *dynamodb.DescribeTableOutput, err error) (bool, error) {
+					if out != nil && out.Table != nil {
+						log.Printf("\twaiting for table %s, status: %s\n",
+							*in.TableName, out.Table.TableStatus)
+					}
+					return dflRetryable(ctx, in, out, err)
+				}
+			})
+
+		dti := dynamodb.DescribeTableInput{TableName: tableName}
+		err := waiter.Wait(dflCtx(), &dti, maxWait)
+		if err != nil {
+			log.Printf("unable to wait for table %s deletion: %v\n", *tableName, err)
+		} else {
+			log.Printf("wait table %s, deleted\n", *tableName)
+		}
+	}
+}
+
+// Wait for all of the lambdas (see config.go) to go from Pending to Active
+func waitLambdasActive(maxWait time.Duration) {
+	if maxWait <= 0 {
+		return
+	}
+
+	for _, lmbd := range lambdas {
+		waitLambdaActive(lmbd.FunctionName, maxWait)
+	}
+}
+
+func waitLambdaActive(name *string, maxWait time.Duration) {
+	waiter := lambda.NewFunctionActiveV2Waiter(svc.lambda,
+		func(o *lambda.FunctionActiveV2WaiterOptions) {
+			dflRetryable := o.Retryable
+			o.Retryable = func(ctx context.Context, in *lambda.GetFunctionInput,
+				out *lambda.GetFunctionOutput, err error) (bool, error) {
+				if out != nil && out.Configuration != nil {
+					log.Printf("\twaiting for lambda %s, state: %s\n",
+						*in.FunctionName, out.Configuration.State)
+				}
+				return dflRetryable(ctx, in, out, err)
+			}
+		})
+
+	gfi := lambda.GetFunctionInput{FunctionName: name}
+	err := waiter.Wait(dflCtx(), &gfi, maxWait)
+	if err != nil {
+		log.Printf("unable to wait for lambda %s: %v\n", *name, err)
+	} else {
+		log.Printf("wait lambda %s, state: Active\n", *name)
+	}
+}
+
+// Wait for a lambda code (or configuration) update to complete
+func waitLambdaUpdated(name *string, maxWait time.Duration) {
+	if maxWait <= 0 {
+		return
+	}
+
+	waiter := lambda.NewFunctionUpdatedV2Waiter(svc.lambda,
+		func(o *lambda.FunctionUpdatedV2WaiterOptions) {
+			dflRetryable := o.Retryable
+			o.Retryable = func(ctx context.Context, in *lambda.GetFunctionInput,
+				out *lambda.GetFunctionOutput, err error) (bool, error) {
+				if out != nil && out.Configuration != nil {
+					log.Printf("\twaiting for lambda %s, last update status: %s\n",
+						*in.FunctionName, out.Configuration.LastUpdateStatus)
+				}
+				return dflRetryable(ctx, in, out, err)
+			}
+		})
+
+	gfi := lambda.GetFunctionInput{FunctionName: name}
+	err := waiter.Wait(dflCtx(), &gfi, maxWait)
+	if err != nil {
+		log.Printf("unable to wait for lambda %s update: %v\n", *name, err)
+	} else {
+		log.Printf("wait lambda %s, last update status: Successful\n", *name)
+	}
+}
+
+// Wait for the state machine to leave the DELETING status. No SDK waiter
+// is available for step functions, so just poll DescribeStateMachine
+func waitStepFunctionDeleted(sfnArn *string, maxWait time.Duration) {
+	if maxWait <= 0 || sfnArn == nil {
+		return
+	}
+
+	deadline := time.Now().Add(maxWait)
+	delay := SFN_WAIT_MIN_DELAY
+
+	for {
+		dsmi := sfn.DescribeStateMachineInput{StateMachineArn: sfnArn}
+		dsmOut, err := svc.sfn.DescribeStateMachine(dflCtx(), &dsmi)
+		if err != nil {
+			var notExists *sfntypes.StateMachineDoesNotExist
+			if errors.As(err, &notExists) {
+				log.Printf("wait sfn %s, deleted\n", *sfnArn)
+			} else {
+				log.Printf("unable to wait for sfn deletion: %v\n", err)
+			}
+			return
+		}
+
+		log.Printf("\twaiting for sfn %s, status: %s\n", *dsmOut.Name, dsmOut.Status)
+
+		if time.Now().Add(delay).After(deadline) {
+			log.Printf("unable to wait for sfn deletion: exceeded max wait time %v\n", maxWait)
+			return
+		}
+
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > SFN_WAIT_MAX_DELAY {
+			delay = SFN_WAIT_MAX_DELAY
+		}
+	}
+}
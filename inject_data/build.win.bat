@@ -1,6 +1,6 @@
 @echo off
 
-set SOURCES=csv_parser.go cngen.go twngen.go injector.go main.go
+set SOURCES=csv_parser.go cngen.go twngen.go injector.go signer.go oauth.go ratelimit.go journal.go checkpoint.go shutdown.go parquet_reader.go catalog.go download.go cli.go generate.go manifest.go main.go
 
 set OUTPUT=bin
 
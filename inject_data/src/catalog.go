@@ -0,0 +1,308 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+ * Dataset catalog
+ *
+ * Datasets are picked by name (--dataset, shell patterns allowed, e.g.
+ * "yellow-2024-*" for a whole year) out of the catalog shipped within the
+ * injector (catalog.json) or a custom one (--catalog). Each one is downloaded
+ * once into cachedir (filename, or the last element of the url) from the
+ * first url that works, and verified against its sha256 (see download.go),
+ * which every catalog entry must pin. Entries of a custom catalog may be
+ * pinned on first use ("pin" subcommand): downloaded once, trusted, and
+ * their sha256 written into the catalog (e.g. tlc.json, TLC monthly Parquet
+ * files, published with no checksum). Local files may be injected as well
+ * (--input, a file, a directory or a pattern), no download nor checksum
+ * involved. Datasets are injected one after the other
+ */
+
+//go:embed catalog.json
+var defaultCatalog []byte
+
+const DEFAULT_DATASET = "yellow-2024-02"
+
+type Dataset struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Urls        []string `json:"urls,omitempty"`
+	Sha256      string   `json:"sha256,omitempty"`   // required in catalogs
+	Format      string   `json:"format,omitempty"`   // csv or parquet
+	Filename    string   `json:"filename,omitempty"` // within cachedir
+	Columns     []string `json:"columns,omitempty"`  // csv ones if no header, parquet ones to send
+
+	path  string // of the file to inject, once there
+	local bool   // --input, as is
+}
+
+type Catalog struct {
+	Datasets []Dataset `json:"datasets"`
+}
+
+// Catalog as it is, datasets not pinned yet (no sha256) included
+func readCatalog(catalogPath string) (*Catalog, error) {
+	catalogBytes := defaultCatalog
+	if len(catalogPath) != 0 {
+		var err error
+		if catalogBytes, err = os.ReadFile(catalogPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var catalog Catalog
+	if err := json.Unmarshal(catalogBytes, &catalog); err != nil {
+		return nil, fmt.Errorf("invalid catalog: %w", err)
+	}
+
+	for _, ds := range catalog.Datasets {
+		if len(ds.Name) == 0 || len(ds.Urls) == 0 {
+			return nil, fmt.Errorf("invalid catalog: dataset %q with no name or urls", ds.Name)
+		}
+
+		if len(ds.Sha256) != 0 && len(ds.Sha256) != 64 {
+			return nil, fmt.Errorf("invalid catalog: dataset %s sha256 is not 64 hex chars", ds.Name)
+		}
+
+		if len(ds.Format) != 0 && !slices.Contains(inputFormats, ds.Format) {
+			return nil, fmt.Errorf("invalid catalog: dataset %s format %q", ds.Name, ds.Format)
+		}
+	}
+
+	return &catalog, nil
+}
+
+// What gets downloaded is always verified: every dataset must be pinned
+func loadCatalog(catalogPath string) (*Catalog, error) {
+	catalog, err := readCatalog(catalogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ds := range catalog.Datasets {
+		if len(ds.Sha256) == 0 {
+			return nil, fmt.Errorf("invalid catalog: dataset %s with no sha256 (see pin)", ds.Name)
+		}
+	}
+
+	return catalog, nil
+}
+
+// Datasets matching the name pattern, in catalog order
+func (catalog *Catalog) find(pattern string) ([]Dataset, error) {
+	var datasets []Dataset
+	for _, ds := range catalog.Datasets {
+		matches, err := path.Match(pattern, ds.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if matches {
+			datasets = append(datasets, ds)
+		}
+	}
+
+	if len(datasets) == 0 {
+		return nil, fmt.Errorf("no dataset %s in catalog (see --list-datasets)", pattern)
+	}
+
+	return datasets, nil
+}
+
+// Filename within cachedir, the last element of the url if not given (with
+// no compression extension, downloads being decompressed)
+func (ds *Dataset) getFilename() string {
+	if len(ds.Filename) != 0 {
+		return ds.Filename
+	}
+
+	if dsUrl, err := url.Parse(ds.Urls[0]); err == nil && len(path.Base(dsUrl.Path)) > 1 {
+		filename := path.Base(dsUrl.Path)
+		for _, ext := range []string{".gz", ".zst"} {
+			filename = strings.TrimSuffix(filename, ext)
+		}
+
+		return filename
+	}
+
+	return ds.Name
+}
+
+func isDatasetFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".csv" || ext == ".parquet"
+}
+
+// Local files: the file itself, csv and parquet files within a directory or
+// matching a pattern, sorted by name (e.g. months in sequence)
+func findLocalDatasets(input string) ([]Dataset, error) {
+	paths := []string{input}
+
+	if info, err := os.Stat(input); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(input)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = nil
+		for _, entry := range entries {
+			if !entry.IsDir() && isDatasetFile(entry.Name()) {
+				paths = append(paths, filepath.Join(input, entry.Name()))
+			}
+		}
+	} else if err != nil {
+		if paths, err = filepath.Glob(input); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no dataset files in %s", input)
+	}
+
+	slices.Sort(paths)
+
+	var datasets []Dataset
+	for _, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		datasets = append(datasets, Dataset{Name: filepath.Base(p), path: absPath, local: true})
+	}
+
+	return datasets, nil
+}
+
+// Datasets to inject, as selected by cmdline
+func getSelectedDatasets() ([]Dataset, error) {
+	var datasets []Dataset
+
+	for _, input := range programConfig.inputs {
+		inputDatasets, err := findLocalDatasets(input)
+		if err != nil {
+			return nil, err
+		}
+
+		datasets = append(datasets, inputDatasets...)
+	}
+
+	if len(programConfig.datasets) == 0 && len(datasets) != 0 {
+		return datasets, nil
+	}
+
+	catalog, err := loadCatalog(programConfig.catalogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := programConfig.datasets
+	if len(patterns) == 0 {
+		patterns = []string{DEFAULT_DATASET}
+	}
+
+	for _, pattern := range patterns {
+		catalogDatasets, err := catalog.find(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		datasets = append(datasets, catalogDatasets...)
+	}
+
+	return datasets, nil
+}
+
+func listDatasets() error {
+	catalog, err := readCatalog(programConfig.catalogPath)
+	if err != nil {
+		return err
+	}
+
+	for _, ds := range catalog.Datasets {
+		format := ds.Format
+		if len(format) == 0 {
+			format = INPUT_FORMAT_AUTO
+		}
+
+		description := ds.Description
+		if len(ds.Sha256) == 0 {
+			description += " [not pinned]"
+		}
+
+		fmt.Printf("%-24s %-8s %s\n", ds.Name, format, description)
+	}
+
+	return nil
+}
+
+// Whether name matches any pattern, all names do if no patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matches, _ := path.Match(pattern, name); matches {
+			return true
+		}
+	}
+
+	return len(patterns) == 0
+}
+
+// Trust on first use: datasets of the catalog (--catalog) with no sha256 are
+// downloaded (or taken from cachedir), and their sha256 written into it
+func pinMain() {
+	if len(programConfig.catalogPath) == 0 {
+		log.Fatalln("pin requires a custom catalog (--catalog), the shipped one is pinned")
+	}
+
+	catalog, err := readCatalog(programConfig.catalogPath)
+	if err != nil {
+		log.Fatalf("unable to read catalog: %s\n", err.Error())
+	}
+
+	pinned := 0
+	for i := range catalog.Datasets {
+		ds := &catalog.Datasets[i]
+		if len(ds.Sha256) != 0 || !matchesAny(programConfig.datasets, ds.Name) {
+			continue
+		}
+
+		log.Printf("pinning dataset %s\n", ds.Name)
+
+		ds.Sha256 = sha256Checksum(getDatasetFile(ds))
+		log.Printf("dataset %s sha256: %s\n", ds.Name, ds.Sha256)
+
+		pinned++
+	}
+
+	if pinned == 0 {
+		log.Println("nothing to pin")
+		return
+	}
+
+	catalogBytes, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		log.Fatalf("unable to encode catalog: %s\n", err.Error())
+	}
+
+	tmpPath := programConfig.catalogPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(catalogBytes, '\n'), 0644); err != nil {
+		log.Fatalf("unable to write catalog: %s\n", err.Error())
+	}
+	if err := os.Rename(tmpPath, programConfig.catalogPath); err != nil {
+		log.Fatalf("unable to write catalog: %s\n", err.Error())
+	}
+
+	log.Printf("%d datasets pinned in %s\n", pinned, programConfig.catalogPath)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Checkpoints (automatic resume)
+ *
+ * The row to resume from, along with its byte offset within the dataset, is
+ * saved in cachedir, one checkpoint per dataset and api endpoint. A row is
+ * acknowledged once sent or journaled as failed; since workers complete rows
+ * out of order, the checkpoint only moves past rows all acknowledged. Next
+ * run seeks straight to the offset (unless --start-at or --no-resume given).
+ * Checkpoint is saved at most every CHECKPOINT_INTERVAL, and removed once the
+ * whole dataset has been sent
+ */
+
+const CHECKPOINT_INTERVAL = time.Second
+
+type Checkpoint struct {
+	Dataset  string `json:"dataset"`
+	Endpoint string `json:"endpoint"`
+
+	// dataset file the offset refers to (e.g. not downloaded again since)
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+
+	Index  int32     `json:"index"`  // next row to send
+	Offset int64     `json:"offset"` // position of the row, see DatasetReader
+	Time   time.Time `json:"time"`
+}
+
+type Checkpointer struct {
+	mu       sync.Mutex
+	path     string
+	state    Checkpoint
+	acked    map[int32]int64 // acknowledged rows past state.Index, to their end offset
+	lastSave time.Time
+}
+
+func getCheckpointPath(dataset string, endpoint string) string {
+	sum := sha256.Sum256([]byte(dataset + "\n" + endpoint))
+
+	return programConfig.cacheDirPath + "/checkpoint_" + hex.EncodeToString(sum[:8]) + ".json"
+}
+
+// Checkpointer for the dataset, with the row to resume from (if any) loaded
+func newCheckpointer(dataset string) (*Checkpointer, error) {
+	info, err := os.Stat(dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := programConfig.injector.http.apiEndpoint
+
+	cp := &Checkpointer{
+		path: getCheckpointPath(dataset, endpoint),
+		state: Checkpoint{
+			Dataset:  dataset,
+			Endpoint: endpoint,
+			Size:     info.Size(),
+			ModTime:  info.ModTime().UTC(),
+		},
+		acked: make(map[int32]int64),
+	}
+
+	if !programConfig.injector.resume {
+		return cp, nil
+	}
+
+	cpBytes, err := os.ReadFile(cp.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved Checkpoint
+	if err := json.Unmarshal(cpBytes, &saved); err != nil {
+		log.Printf("ignoring checkpoint %s: %s\n", cp.path, err.Error())
+		return cp, nil
+	}
+
+	if saved.Size != cp.state.Size || !saved.ModTime.Equal(cp.state.ModTime) {
+		log.Printf("ignoring checkpoint %s: dataset changed since\n", cp.path)
+		return cp, nil
+	}
+
+	cp.state.Index = saved.Index
+	cp.state.Offset = saved.Offset
+
+	log.Printf("resuming from entry %d (checkpoint %s, saved %s)\n",
+		saved.Index, cp.path, saved.Time.Format(time.RFC3339))
+
+	return cp, nil
+}
+
+// Row to start from and its byte offset (0: unknown, rows are to be skipped)
+func (cp *Checkpointer) start(index int32) (int32, int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.state.Index > 0 {
+		return cp.state.Index, cp.state.Offset
+	}
+
+	cp.state.Index = index
+
+	return index, 0
+}
+
+func (cp *Checkpointer) ack(entry Entry) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.acked[entry.index] = entry.offset
+
+	for {
+		offset, found := cp.acked[cp.state.Index]
+		if !found {
+			break
+		}
+
+		delete(cp.acked, cp.state.Index)
+		cp.state.Index++
+		cp.state.Offset = offset
+	}
+
+	if time.Since(cp.lastSave) >= CHECKPOINT_INTERVAL {
+		if err := cp.saveLocked(); err != nil {
+			log.Printf(" --> Unable to save checkpoint: %s\n", err.Error())
+		}
+	}
+}
+
+func (cp *Checkpointer) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.saveLocked()
+}
+
+// Written aside then renamed, never leaving a truncated checkpoint behind
+func (cp *Checkpointer) saveLocked() error {
+	cp.lastSave = time.Now()
+
+	if cp.state.Offset == 0 {
+		return nil
+	}
+
+	cp.state.Time = cp.lastSave.UTC()
+
+	cpBytes, err := json.MarshalIndent(&cp.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(cp.path+".tmp", cpBytes, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(cp.path+".tmp", cp.path)
+}
+
+// Dataset sent as a whole, next run starts over
+func (cp *Checkpointer) remove() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	err := os.Remove(cp.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Command line: "inject_data [<subcommand>] [options]", inject being the
+ * subcommand when none is given. Each subcommand has its own (typed) options,
+ * unknown ones being an error, "-h" prints them along with their defaults.
+ *
+ * Options may as well be given by environment variable (INJECT_DATA_ and the
+ * option name, upper case, e.g. INJECT_DATA_AUTH_KEY for --auth-key) or by
+ * config file (--config, or else config.json within default cachedir, if
+ * there): a JSON object of option names, e.g. {"rps": 20, "dataset":
+ * ["yellow-2024-*"]}. Cmdline wins over environment, which wins over config
+ * file, which wins over deploy outputs
+ */
+
+const ENV_VAR_PREFIX = "INJECT_DATA_"
+const DEFAULT_CONFIG_FILE_NAME = "config.json"
+
+type Subcommand struct {
+	name        string
+	description string
+	flags       []func(fs *flag.FlagSet)
+	run         func()
+}
+
+var subcommands = []Subcommand{
+	{
+		name:        "inject",
+		description: "Send datasets (dirty data included) to the pipeline, the default",
+		flags:       []func(fs *flag.FlagSet){datasetFlags, downloadFlags, readerFlags, injectorFlags},
+		run:         injectMain,
+	},
+	{
+		name:        "download",
+		description: "Download (and verify) datasets into cachedir, nothing sent",
+		flags:       []func(fs *flag.FlagSet){datasetFlags, downloadFlags},
+		run:         downloadMain,
+	},
+	{
+		name:        "verify",
+		description: "Verify datasets within cachedir against their checksums, nothing downloaded",
+		flags:       []func(fs *flag.FlagSet){datasetFlags},
+		run:         verifyMain,
+	},
+	{
+		name:        "pin",
+		description: "Download datasets of --catalog with no checksum and write their checksums into it",
+		flags:       []func(fs *flag.FlagSet){datasetFlags},
+		run:         pinMain,
+	},
+	{
+		name:        "generate",
+		description: "Write the tuples (dirty data included) that would be sent, nothing sent",
+		flags:       []func(fs *flag.FlagSet){datasetFlags, downloadFlags, readerFlags, generatorFlags},
+		run:         generateMain,
+	},
+}
+
+// Options set by cmdline, environment or config file (i.e. not defaults)
+var explicitFlags = map[string]bool{}
+
+func isFlagSet(name string) bool {
+	return explicitFlags[name]
+}
+
+// One of values
+type EnumValue struct {
+	p      *string
+	values []string
+}
+
+func (v *EnumValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+
+	return *v.p
+}
+
+func (v *EnumValue) Set(value string) error {
+	if !slices.Contains(v.values, value) {
+		return fmt.Errorf("must be one of: %s", strings.Join(v.values, ", "))
+	}
+
+	*v.p = value
+
+	return nil
+}
+
+// Appended to every time given, comma separated values unless no sep
+type ListValue struct {
+	p   *[]string
+	sep string
+}
+
+func (v *ListValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+
+	return strings.Join(*v.p, ",")
+}
+
+func (v *ListValue) Set(value string) error {
+	if len(v.sep) == 0 {
+		*v.p = append(*v.p, value)
+	} else {
+		*v.p = append(*v.p, strings.Split(value, v.sep)...)
+	}
+
+	return nil
+}
+
+// Datasets to work on, as well as the options of every subcommand
+func datasetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&programConfig.configPath, "config", "",
+		"Read options from this JSON file (default <cachedir>/"+DEFAULT_CONFIG_FILE_NAME+", if there)")
+	fs.StringVar(&programConfig.cacheDirPath, "cachedir", programConfig.cacheDirPath,
+		"Cache directory (datasets, checkpoints, failed rows)")
+	fs.Var(&ListValue{p: &programConfig.datasets, sep: ","}, "dataset",
+		"Catalog dataset(s), comma separated names or patterns (e.g. yellow-2024-*), one after the other"+
+			" (default "+DEFAULT_DATASET+", unless --input)")
+	fs.StringVar(&programConfig.catalogPath, "catalog", "", "Custom dataset catalog (JSON) file")
+	fs.BoolVar(&programConfig.listDatasets, "list-datasets", false, "Print catalog datasets and exit")
+	fs.StringVar(&programConfig.filename, "filename", "",
+		"Custom relative (to cachedir) filename, instead of the dataset one")
+	fs.StringVar(&programConfig.checksum, "checksum", "",
+		"Custom checksum (SHA256, hex encoded), instead of the dataset one")
+}
+
+func downloadFlags(fs *flag.FlagSet) {
+	fs.StringVar(&programConfig.downloadUrl, "download", "", "Custom URL to download from, instead of the dataset ones")
+	fs.BoolVar(&programConfig.skipDownload, "skip-download", programConfig.skipDownload,
+		"Do not download anything, datasets must be within cachedir")
+	fs.BoolVar(&programConfig.skipChecksum, "skip-checksum", programConfig.skipChecksum,
+		"Do not verify checksums")
+}
+
+// Reading datasets and generating dirty data out of them
+func readerFlags(fs *flag.FlagSet) {
+	fs.Var(&ListValue{p: &programConfig.inputs}, "input",
+		"Local csv or parquet file(s): a file, a directory or a pattern (e.g. data/*.parquet), instead of --dataset")
+	fs.Var(&EnumValue{p: &programConfig.inputFormat, values: inputFormats}, "input-format",
+		"Dataset format: csv, parquet or auto (by filename extension)")
+	fs.Var(&ListValue{p: &programConfig.parquetColumns, sep: ","}, "parquet-columns",
+		"Comma separated parquet columns making up tuples, in order (after row number), instead of the schema ones")
+	fs.StringVar(&programConfig.csv.separator, "csv-separator", programConfig.csv.separator,
+		"Csv column separator (1 chr)")
+	fs.Var(&EnumValue{p: &programConfig.csv.header, values: csvHeaderModes}, "csv-header",
+		"Whether first csv line holds column names (first), is to be skipped (skip) or is a line like the others (none)")
+	fs.Var(&ListValue{p: &programConfig.csv.columns, sep: ","}, "csv-columns",
+		"Comma separated csv column names, if not taken from header")
+	fs.Var(&EnumValue{p: &programConfig.csv.malformed, values: csvMalformedPolicies}, "csv-malformed",
+		"What to do with malformed csv lines: log and skip (skip), send as they are (raw) or stop (abort)")
+	fs.IntVar(&programConfig.injector.startAt, "start-at", programConfig.injector.startAt,
+		"Start from i-th entry (of the first dataset), instead of the checkpoint if any")
+	fs.BoolVar(&programConfig.generator.dirtyData, "dirty-data", programConfig.generator.dirtyData,
+		"Generate dirty data (random)")
+	fs.Float64Var(&programConfig.generator.dirtyThresh, "dirty-thresh", programConfig.generator.dirtyThresh,
+		"Threshold to dirty data, checked against PRNG-generated num in (0,1)")
+	fs.Uint64Var(&programConfig.generator.seed, "seed", 0,
+		"Seed dirty data is generated with, the same rows getting the same noise (default random)")
+	fs.StringVar(&programConfig.generator.manifestPath, "manifest", "",
+		"Append what noise every tuple got, and the validation outcome expected, to this file (JSON lines)")
+}
+
+func injectorFlags(fs *flag.FlagSet) {
+	fs.IntVar(&programConfig.generator.everyMs, "every-ms", programConfig.generator.everyMs,
+		"Send an entry every X ms (single worker, ignored along with --rps or --concurrency > 1)")
+	fs.StringVar(&programConfig.injector.http.apiEndpoint, "api-endpoint", programConfig.injector.http.apiEndpoint,
+		"API gateway endpoint to send data to")
+	fs.StringVar(&programConfig.outputsPath, "outputs", "",
+		"Take API gateway endpoint (and authorizer) from this deploy outputs file (deploy status -o)")
+	fs.StringVar(&programConfig.injector.http.authKey, "auth-key", programConfig.injector.http.authKey,
+		"Authenticate via secret key")
+	fs.BoolVar(&programConfig.injector.http.sign, "sign", programConfig.injector.http.sign,
+		"Sign requests (HMAC-SHA256) with auth key instead of sending it (deploy -auth-mode hmac)")
+	fs.StringVar(&programConfig.injector.http.clientId, "client-id", programConfig.injector.http.clientId,
+		"Client id auth key (signed requests) or client secret (jwt) belongs to")
+	fs.StringVar(&programConfig.injector.http.tokenEndpoint, "token-endpoint", programConfig.injector.http.tokenEndpoint,
+		"Enable jwt authorization, tokens from this OAuth2 endpoint (client credentials)")
+	fs.StringVar(&programConfig.injector.http.issuer, "issuer", programConfig.injector.http.issuer,
+		"Enable jwt authorization, token endpoint discovered from this OIDC issuer")
+	fs.StringVar(&programConfig.injector.http.clientSecret, "client-secret", "",
+		"Client secret to obtain tokens with (jwt only)")
+	fs.StringVar(&programConfig.injector.http.scope, "scope", programConfig.injector.http.scope,
+		"Space-separated scopes to request tokens for (jwt only)")
+	fs.StringVar(&programConfig.injector.http.audience, "audience", "",
+		"Audience to request tokens for, if the provider needs it (jwt only)")
+	fs.IntVar(&programConfig.injector.concurrency, "concurrency", programConfig.injector.concurrency,
+		"Number of requests in flight at once (--every-ms ignored if more than 1)")
+	fs.Float64Var(&programConfig.injector.rps, "rps", programConfig.injector.rps,
+		"Max requests per second, lowered while the api pushes back (0: unlimited, --every-ms ignored otherwise)")
+	fs.IntVar(&programConfig.injector.burst, "burst", programConfig.injector.burst,
+		"Max requests sent at once when under --rps")
+	fs.IntVar(&programConfig.injector.maxRetries, "max-retries", programConfig.injector.maxRetries,
+		"Max retries of a request failing with a network error, HTTP 408, 429 or 5xx")
+	fs.StringVar(&programConfig.injector.journalPath, "failed-journal", "",
+		"File rows failed for good are journaled to (default <cachedir>/"+DEFAULT_JOURNAL_FILE_NAME+")")
+	fs.BoolVar(&programConfig.injector.retryFailed, "retry-failed", false,
+		"Send again the rows journaled as failed, instead of the dataset")
+	fs.DurationVar(&programConfig.injector.drainTimeout, "drain-timeout", programConfig.injector.drainTimeout,
+		"How long requests in flight may take to complete once stopped (CTRL+C)")
+	fs.BoolFunc("no-resume", "Ignore the checkpoint left by an interrupted run, starting from --start-at",
+		func(value string) error {
+			noResume, err := strconv.ParseBool(value)
+			programConfig.injector.resume = !noResume
+
+			return err
+		})
+}
+
+func generatorFlags(fs *flag.FlagSet) {
+	fs.StringVar(&programConfig.generator.output, "output", DEFAULT_GENERATE_OUTPUT,
+		"File to write tuples to, one per line (-: stdout)")
+}
+
+func getEnvVarName(flagName string) string {
+	return ENV_VAR_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Options of every subcommand
+func getAllFlagNames() map[string]bool {
+	names := map[string]bool{}
+
+	// defining options assigns their defaults
+	savedConfig := programConfig
+	defer func() { programConfig = savedConfig }()
+
+	for _, sc := range subcommands {
+		fs := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+		for _, addFlags := range sc.flags {
+			addFlags(fs)
+		}
+
+		fs.VisitAll(func(f *flag.Flag) {
+			names[f.Name] = true
+		})
+	}
+
+	return names
+}
+
+// Config file values by option name, as cmdline values (arrays: list values)
+func loadConfigFile(path string, fs *flag.FlagSet) (map[string][]string, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]any
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	allFlagNames := getAllFlagNames()
+
+	values := map[string][]string{}
+	for name, value := range config {
+		if !allFlagNames[name] || name == "config" {
+			return nil, fmt.Errorf("invalid config: unknown option %s", name)
+		}
+
+		// options of other subcommands are ignored
+		if fs.Lookup(name) == nil {
+			continue
+		}
+
+		elems, isArray := value.([]any)
+		if !isArray {
+			elems = []any{value}
+		}
+
+		for _, elem := range elems {
+			switch v := elem.(type) {
+			case string:
+				values[name] = append(values[name], v)
+			case float64:
+				values[name] = append(values[name], strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				values[name] = append(values[name], strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("invalid config: option %s value %v", name, elem)
+			}
+		}
+	}
+
+	return values, nil
+}
+
+func getConfigFilePath() string {
+	if len(programConfig.configPath) != 0 {
+		return programConfig.configPath
+	}
+
+	if envPath, found := os.LookupEnv(getEnvVarName("config")); found {
+		return envPath
+	}
+
+	dflConfigPath := getHomeDir() + "/" + DEFAULT_CACHEDIR_RELNAME + "/" + DEFAULT_CONFIG_FILE_NAME
+	if _, err := os.Stat(dflConfigPath); err == nil {
+		return dflConfigPath
+	}
+
+	return ""
+}
+
+// Options not given by cmdline, from environment or else config file
+func applyEnvAndConfigFile(fs *flag.FlagSet) {
+	configValues := map[string][]string{}
+
+	configPath := getConfigFilePath()
+	if len(configPath) != 0 {
+		var err error
+		if configValues, err = loadConfigFile(configPath, fs); err != nil {
+			log.Fatalf("unable to load config %s: %s\n", configPath, err.Error())
+		}
+
+		log.Printf("options taken from config %s\n", configPath)
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if isFlagSet(f.Name) || f.Name == "config" {
+			return
+		}
+
+		source := "config " + configPath
+		values := configValues[f.Name]
+
+		envName := getEnvVarName(f.Name)
+		if envValue, found := os.LookupEnv(envName); found {
+			source = "environment " + envName
+			values = []string{envValue}
+		}
+
+		for _, value := range values {
+			if err := fs.Set(f.Name, value); err != nil {
+				log.Fatalf("invalid value %q for --%s (%s): %s\n", value, f.Name, source, err.Error())
+			}
+
+			explicitFlags[f.Name] = true
+		}
+	})
+}
+
+func printUsage(sc *Subcommand, fs *flag.FlagSet) {
+	out := fs.Output()
+
+	fmt.Fprintf(out, "Usage: %s [<subcommand>] [options]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Subcommands (use <subcommand> -h to get help on its options):")
+	for _, other := range subcommands {
+		fmt.Fprintf(out, "  %-10s %s\n", other.name, other.description)
+	}
+
+	fmt.Fprintf(out, "\nOptions of %s (also as %s<OPTION> environment variables or config file keys):\n",
+		sc.name, ENV_VAR_PREFIX)
+	fs.PrintDefaults()
+}
+
+// Subcommand by name, inject if args start with options (or there are none)
+func getSubcommand(args []string) (*Subcommand, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return &subcommands[0], args
+	}
+
+	for i := range subcommands {
+		if args[0] == subcommands[i].name {
+			return &subcommands[i], args[1:]
+		}
+	}
+
+	fs := flag.NewFlagSet(subcommands[0].name, flag.ExitOnError)
+	for _, addFlags := range subcommands[0].flags {
+		addFlags(fs)
+	}
+
+	fmt.Fprintf(fs.Output(), "unknown subcommand %s\n", args[0])
+	printUsage(&subcommands[0], fs)
+	os.Exit(2)
+
+	return nil, nil
+}
+
+func parseCmdline(sc *Subcommand, args []string) {
+	loadDefaults()
+
+	fs := flag.NewFlagSet(sc.name, flag.ExitOnError)
+	for _, addFlags := range sc.flags {
+		addFlags(fs)
+	}
+
+	fs.Usage = func() { printUsage(sc, fs) }
+
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fmt.Fprintf(fs.Output(), "unexpected argument %s\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	applyEnvAndConfigFile(fs)
+
+	if len(programConfig.outputsPath) != 0 {
+		if err := loadDeployOutputs(programConfig.outputsPath); err != nil {
+			log.Fatalf("unable to load deploy outputs %s: %s\n", programConfig.outputsPath, err.Error())
+		}
+	}
+
+	if isFlagSet("start-at") {
+		programConfig.injector.resume = false
+	}
+
+	if !isFlagSet("seed") {
+		programConfig.generator.seed = rand.Uint64()
+	}
+
+	if err := validateConfig(); err != nil {
+		fmt.Fprintln(fs.Output(), err.Error())
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	uniformConfigParameters()
+}
@@ -3,34 +3,131 @@ package main
 import (
 	"errors"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 type ColumnNoiseGenerator struct {
 	columnName string
+	critical   bool // dirty values get the tuple rejected, or else blanked by validation
+	amount     bool // summing up to total_amount, see getExpectedOutcome
 	callback   func(string) string
 }
 
+// Noise is drawn from a generator seeded, on every row, out of --seed, dataset
+// name and row index: a row gets the very same noise whatever the row the run
+// started from, the number of rows sent at once and so on
+var noiseSource = rand.NewPCG(0, 0)
+var noiseRand = rand.New(noiseSource)
+
+func getDatasetNoiseSeed(ds *Dataset) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(ds.Name))
+
+	return programConfig.generator.seed ^ hasher.Sum64()
+}
+
+func logNoiseSeed() {
+	if programConfig.generator.dirtyData {
+		log.Printf("noise seed %d (--seed to generate the same dirty data again)\n",
+			programConfig.generator.seed)
+	}
+}
+
+// Tuple ready to be sent, along with its index among dataset rows (i.e.
+// the --start-at value to resume from it)
+type Entry struct {
+	index  int32
+	offset int64 // position of the row following this one
+	tuple  string
+}
+
+// Rows of the dataset, either csv or parquet
+type DatasetReader interface {
+	readNextLine() ([]CsvEntry, error)
+	seek(offset int64) error
+	position() int64 // to seek to later on: byte offset (csv), row number (parquet)
+	close()
+}
+
+// By file extension, dflFormat if none of the known ones
+func getFileFormat(path string, dflFormat string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".parquet":
+		return INPUT_FORMAT_PARQUET
+	case ".csv":
+		return INPUT_FORMAT_CSV
+	}
+
+	if len(dflFormat) == 0 {
+		return INPUT_FORMAT_CSV
+	}
+
+	return dflFormat
+}
+
+// Format and columns given by cmdline, or else by dataset (catalog)
+func openDataset(ds *Dataset) (DatasetReader, error) {
+	format := programConfig.inputFormat
+	if format == INPUT_FORMAT_AUTO {
+		format = getFileFormat(ds.path, ds.Format)
+	}
+
+	if format == INPUT_FORMAT_PARQUET {
+		columns := programConfig.parquetColumns
+		if len(columns) == 0 {
+			columns = ds.Columns
+		}
+
+		return openParquet(ds.path, columns)
+	}
+
+	columns := programConfig.csv.columns
+	if len(columns) == 0 {
+		columns = ds.Columns
+	}
+
+	csv, err := openCsv(ds.path, programConfig.csv.separator, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csv, nil
+}
+
 type ColumnNoiseGenerationChannels struct {
-	outEntry chan string
+	outEntry chan Entry
 	outErr   chan error
 }
 
-func readTuplesAndGenerateColumnNoise(
-	filePath string, noiseGens []ColumnNoiseGenerator, chans ColumnNoiseGenerationChannels) {
+// Rows are read from startAt, seeking straight to startOffset if known (> 0)
+func readTuplesAndGenerateColumnNoise(ds *Dataset, startAt int32, startOffset int64,
+	noiseGens []ColumnNoiseGenerator, manifest *Manifest, chans ColumnNoiseGenerationChannels) {
 
+	// rate is up to the injector (workers and ratelimit.go) if either given
 	delay := time.Duration(programConfig.generator.everyMs) * time.Millisecond
+	if programConfig.injector.rps > 0 || programConfig.injector.concurrency > 1 {
+		delay = 0
+	}
 
-	csv, err := openCsv(filePath, programConfig.csv.separator)
+	dataset, err := openDataset(ds)
 	if err != nil {
 		closeChansWithErr(err, &chans)
 		return
 	}
 
-	defer csv.close()
+	defer dataset.close()
 
-	err = discardFirstEntriesAsRequired(&csv)
+	if startOffset > 0 {
+		err = dataset.seek(startOffset)
+	} else {
+		err = discardFirstEntriesAsRequired(dataset, startAt)
+	}
 	if err != nil {
 		closeChansWithErr(err, &chans)
 		return
@@ -38,15 +135,44 @@ func readTuplesAndGenerateColumnNoise(
 
 	var parseErr error
 
+	index := startAt
+	dsSeed := getDatasetNoiseSeed(ds)
+
 	for {
-		ents, parseErr := csv.readNextLine()
-		if parseErr != nil {
+		if stopRequested() {
+			closeChansWithErr(errInjectionStopped, &chans)
+			return
+		}
+
+		ents, err := dataset.readNextLine()
+		if err != nil {
+			parseErr = err
 			break
 		}
 
-		out := generateColumnNoise(&ents, &noiseGens)
-		chans.outEntry <- out[:len(out)-1]
-		time.Sleep(delay)
+		noiseSource.Seed(dsSeed, uint64(index))
+
+		out, noise := generateColumnNoise(&ents, &noiseGens)
+		tuple := out[:len(out)-1]
+		tupleNoise := generateTupleWiseNoise(&tuple, &tupleWiseNoiseGens)
+
+		err = manifest.record(ManifestRecord{
+			Dataset:    ds.Name,
+			Index:      index,
+			Seed:       programConfig.generator.seed,
+			Noise:      noise,
+			TupleNoise: tupleNoise,
+			Malformed:  len(ents) != 0 && ents[0].columnIndex < 0,
+			Tuple:      tuple,
+		})
+		if err != nil {
+			closeChansWithErr(fmt.Errorf("unable to write manifest: %w", err), &chans)
+			return
+		}
+
+		chans.outEntry <- Entry{index: index, offset: dataset.position(), tuple: tuple}
+		index++
+		sleepUnlessStopped(delay)
 	}
 
 	closeChansWithErr(parseErr, &chans)
@@ -55,53 +181,69 @@ func readTuplesAndGenerateColumnNoise(
 func closeChansWithErr(myerr error, chs *ColumnNoiseGenerationChannels) {
 	close(chs.outEntry)
 
-	var csvEofError *CsvEofError
-	if errors.As(myerr, &csvEofError) {
+	var csvEofError CsvEofError
+	if myerr == nil || errors.As(myerr, &csvEofError) {
 		chs.outErr <- nil
 	} else {
 		chs.outErr <- myerr
 	}
 }
 
-func discardFirstEntriesAsRequired(csv *Csv) error {
-	n := programConfig.injector.startAt
+func discardFirstEntriesAsRequired(dataset DatasetReader, n int32) error {
 
 	for i := int32(0); i < n; i++ {
-		_, err := csv.readNextLine()
+		_, err := dataset.readNextLine()
 		if err != nil {
 			return err
 		}
-		fmt.Printf(" --> Skipping first %d entries\r", i+1)
+		fmt.Fprintf(os.Stderr, " --> Skipping first %d entries\r", i+1)
 	}
 
 	if n > 0 {
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 	}
 
 	return nil
 }
 
-func generateColumnNoise(ents *[]CsvEntry, noiseGens *[]ColumnNoiseGenerator) string {
+// Tuple, along with the dirty values it got
+func generateColumnNoise(ents *[]CsvEntry, noiseGens *[]ColumnNoiseGenerator) (string, []ColumnNoise) {
 	needsDirtyData := programConfig.generator.dirtyData
-	threshDirtyData := programConfig.generator.dirtyThresh
+	threshDirtyData := float32(programConfig.generator.dirtyThresh)
 
-	genDirty := needsDirtyData && rand.Float32() > threshDirtyData
+	genDirty := needsDirtyData && noiseRand.Float32() > threshDirtyData
 
 	out := ""
 
+	var noise []ColumnNoise
+
 	for _, ent := range *ents {
 		if genDirty {
-			if rand.Float32() >= 0.7 {
+			if noiseRand.Float32() >= 0.7 {
 				gen, genErr := findColumnNoiseGenerator(noiseGens, &ent)
 				if genErr == nil && gen.callback != nil {
-					ent.value = gen.callback(ent.value)
+					value := gen.callback(ent.value)
+					if value != ent.value {
+						noise = append(noise, ColumnNoise{
+							Column:   ent.columnName,
+							Index:    ent.columnIndex,
+							Value:    value,
+							critical: gen.critical,
+							amount:   gen.amount,
+						})
+					}
+
+					ent.value = value
 				}
 			}
 		}
+		if ent.columnIndex >= 0 {
+			ent.value = encodeCsvField(ent.value, programConfig.csv.separator)
+		}
 		out += ent.value + programConfig.csv.separator
 	}
 
-	return out
+	return out, noise
 }
 
 func findColumnNoiseGenerator(gs *[]ColumnNoiseGenerator, c *CsvEntry) (ColumnNoiseGenerator, error) {
@@ -111,5 +253,5 @@ func findColumnNoiseGenerator(gs *[]ColumnNoiseGenerator, c *CsvEntry) (ColumnNo
 		}
 	}
 
-	return ColumnNoiseGenerator{"", nil}, errors.New("no matching NoiseGenerator")
+	return ColumnNoiseGenerator{}, errors.New("no matching NoiseGenerator")
 }
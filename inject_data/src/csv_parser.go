@@ -1,18 +1,48 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	encsv "encoding/csv"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
+/*
+ * RFC 4180 csv: quoted fields (separators, escaped quotes and newlines
+ * within), UTF-8 BOM, CRLF or LF line endings
+ *
+ * Header (--csv-header): "first" line holds column names, or it is to be
+ * "skip"ped, or there is "none" at all. Column names are taken from
+ * --csv-columns unless "first", falling back to column numbers (1, 2, ...).
+ * Malformed lines (bad quoting, wrong number of columns) are either "skip"ped
+ * (logged), sent "raw" (as they are in the file) or "abort" the injection
+ */
+
+const CSV_HEADER_FIRST = "first"
+const CSV_HEADER_SKIP = "skip"
+const CSV_HEADER_NONE = "none"
+
+const CSV_MALFORMED_SKIP = "skip"
+const CSV_MALFORMED_RAW = "raw"
+const CSV_MALFORMED_ABORT = "abort"
+
+var csvHeaderModes = []string{CSV_HEADER_FIRST, CSV_HEADER_SKIP, CSV_HEADER_NONE}
+var csvMalformedPolicies = []string{CSV_MALFORMED_SKIP, CSV_MALFORMED_RAW, CSV_MALFORMED_ABORT}
+
+var utf8Bom = []byte{0xEF, 0xBB, 0xBF}
+
 type Csv struct {
 	file   *os.File
-	reader *bufio.Reader
+	reader *encsv.Reader
 	header []string
 	sepCh  string
+	base   int64 // file offset the reader started from
+	offset int64 // of the next line to be read
 }
 
 type InvalidCsvError struct {
@@ -29,7 +59,8 @@ func (e CsvEofError) Error() string {
 	return "eof"
 }
 
-func openCsv(filepath string, commaCh string) (Csv, error) {
+// Column names are only used when not taken from header
+func openCsv(filepath string, commaCh string, columns []string) (Csv, error) {
 	csv := Csv{}
 
 	f, err := os.Open(filepath)
@@ -37,65 +68,166 @@ func openCsv(filepath string, commaCh string) (Csv, error) {
 		return csv, err
 	}
 
-	csv.reader = bufio.NewReader(f)
+	csv.file = f
+	csv.sepCh = commaCh
 
-	hdrLn, err := csv.reader.ReadString('\n')
-	if err != nil {
+	bom := make([]byte, len(utf8Bom))
+	if n, _ := io.ReadFull(f, bom); n == len(utf8Bom) && bytes.Equal(bom, utf8Bom) {
+		csv.base = int64(n)
+	}
+
+	if err := csv.seek(csv.base); err != nil {
 		csv.close()
-		return csv, InvalidCsvError{cause: err}
+		return csv, err
 	}
 
-	hdrLn = strings.TrimRight(hdrLn, "\r\n")
+	headerMode := programConfig.csv.header
+
+	if headerMode == CSV_HEADER_FIRST || headerMode == CSV_HEADER_SKIP {
+		hdr, err := csv.reader.Read()
+		if err != nil {
+			csv.close()
+			return csv, InvalidCsvError{cause: err}
+		}
 
-	csv.header = strings.Split(hdrLn, commaCh)
+		csv.offset = csv.base + csv.reader.InputOffset()
+
+		if headerMode == CSV_HEADER_FIRST {
+			csv.header = hdr
+		}
+	}
 
 	if len(csv.header) == 0 {
-		csv.close()
-		return csv, InvalidCsvError{errors.New("no columns")}
+		csv.header = columns
 	}
 
-	csv.sepCh = commaCh
-	csv.file = f
+	// columns are counted on the first line, if not named
+	if len(csv.header) != 0 {
+		csv.reader.FieldsPerRecord = len(csv.header)
+	}
 
 	return csv, nil
 }
 
 type CsvEntry struct {
-	columnIndex int
+	columnIndex int // -1: whole raw line (malformed)
 	columnName  string
 	value       string
 }
 
-func (csv Csv) readNextLine() ([]CsvEntry, error) {
-	entryLn, err := csv.reader.ReadString('\n')
-	if err != nil {
-		csv.close()
-		return nil, CsvEofError{}
+// Jump to the line starting at offset (as read from csv.offset earlier on)
+func (csv *Csv) seek(offset int64) error {
+	if offset < csv.offset {
+		return InvalidCsvError{cause: fmt.Errorf("offset %d within header", offset)}
 	}
 
-	entryLn = strings.TrimRight(entryLn, "\r\n")
-	colsVals := strings.Split(entryLn, csv.sepCh)
-	if len(colsVals) != len(csv.header) {
-		csv.close()
-		return nil, InvalidCsvError{cause: errors.New("invalid num of cols")}
+	if _, err := csv.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	fieldsPerRecord := 0
+	if csv.reader != nil {
+		fieldsPerRecord = csv.reader.FieldsPerRecord
+	}
+
+	csv.reader = encsv.NewReader(csv.file)
+	csv.reader.Comma = []rune(csv.sepCh)[0]
+	csv.reader.FieldsPerRecord = fieldsPerRecord
+	csv.base = offset
+	csv.offset = offset
+
+	return nil
+}
+
+func (csv *Csv) position() int64 {
+	return csv.offset
+}
+
+// Line as it is in the file, line ending excluded
+func (csv *Csv) readRawLine(from int64, to int64) (string, error) {
+	rawLn := make([]byte, to-from)
+	if _, err := csv.file.ReadAt(rawLn, from); err != nil {
+		return "", err
 	}
 
-	ents := []CsvEntry{}
-	for idx, elem := range colsVals {
-		ents = append(
-			ents,
-			CsvEntry{
-				columnIndex: idx,
-				columnName:  csv.header[idx],
-				value:       elem,
-			})
+	return strings.TrimRight(string(rawLn), "\r\n"), nil
+}
+
+// Next well formed line (or malformed one, when sent raw)
+func (csv *Csv) readNextLine() ([]CsvEntry, error) {
+	for {
+		from := csv.offset
+
+		colsVals, err := csv.reader.Read()
+		if errors.Is(err, io.EOF) {
+			csv.close()
+			return nil, CsvEofError{}
+		}
+
+		csv.offset = csv.base + csv.reader.InputOffset()
+
+		if err != nil {
+			var parseErr *encsv.ParseError
+			if !errors.As(err, &parseErr) {
+				csv.close()
+				return nil, err
+			}
+
+			switch programConfig.csv.malformed {
+			case CSV_MALFORMED_ABORT:
+				csv.close()
+				return nil, InvalidCsvError{cause: err}
+
+			case CSV_MALFORMED_RAW:
+				rawLn, err := csv.readRawLine(from, csv.offset)
+				if err != nil {
+					csv.close()
+					return nil, err
+				}
+
+				log.Printf(" --> Sending malformed line raw: %s\n", parseErr.Error())
+				return []CsvEntry{{columnIndex: -1, value: rawLn}}, nil
+
+			default:
+				log.Printf(" --> Skipping malformed line: %s\n", parseErr.Error())
+				continue
+			}
+		}
+
+		if len(csv.header) == 0 {
+			for idx := range colsVals {
+				csv.header = append(csv.header, strconv.Itoa(idx+1))
+			}
+		}
+
+		ents := []CsvEntry{}
+		for idx, elem := range colsVals {
+			ents = append(
+				ents,
+				CsvEntry{
+					columnIndex: idx,
+					columnName:  csv.header[idx],
+					value:       elem,
+				})
+		}
+
+		return ents, nil
+	}
+}
+
+// Quoted only if needed, i.e. most tuples are sent as they are in the file
+func encodeCsvField(value string, sepCh string) string {
+	if !strings.ContainsAny(value, sepCh+"\"\r\n") {
+		return value
 	}
 
-	return ents, nil
+	return "\"" + strings.ReplaceAll(value, "\"", "\"\"") + "\""
 }
 
-func (csv Csv) close() {
-	csv.file.Close()
+func (csv *Csv) close() {
+	if csv.file != nil {
+		csv.file.Close()
+	}
 	csv.reader = nil
 	csv.file = nil
 	csv.header = []string{}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+ * Dataset downloads
+ *
+ * Response bodies are streamed into "<file>.part", hashed on the fly, and
+ * renamed into place only once complete and verified, so that a dataset in
+ * cachedir is always a whole one. An interrupted download is resumed (HTTP
+ * range request) from where it stopped, provided the source did not change
+ * meanwhile (If-Range). Gzip and zstd compressed sources (told by their magic
+ * bytes) are decompressed into place, the checksum being the decompressed
+ * dataset one
+ */
+
+const DOWNLOAD_PROGRESS_INTERVAL = 500 * time.Millisecond
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var errChecksumMismatch = errors.New("checksums do not match")
+
+// What a partial download was downloaded from (<file>.part.json)
+type DownloadSource struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+type DownloadProgress struct {
+	done      int64
+	total     int64 // -1: unknown
+	lastPrint time.Time
+}
+
+func (p *DownloadProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+
+	if time.Since(p.lastPrint) >= DOWNLOAD_PROGRESS_INTERVAL {
+		p.print()
+	}
+
+	return len(b), nil
+}
+
+func (p *DownloadProgress) print() {
+	p.lastPrint = time.Now()
+
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, " --> Downloaded %.1f of %.1f MiB (%d%%)\r",
+			float64(p.done)/(1<<20), float64(p.total)/(1<<20), p.done*100/p.total)
+	} else {
+		fmt.Fprintf(os.Stderr, " --> Downloaded %.1f MiB\r", float64(p.done)/(1<<20))
+	}
+}
+
+func getHexSum(hasher hash.Hash) string {
+	return strings.ToUpper(hex.EncodeToString(hasher.Sum(nil)))
+}
+
+func sha256Checksum(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "failfailfail"
+	}
+
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "failfailfail"
+	}
+
+	return getHexSum(hasher)
+}
+
+// Source of the partial download, if any and resumable from url
+func getPartialDownload(url string, partPath string) (*DownloadSource, int64) {
+	info, err := os.Stat(partPath)
+	if err != nil || info.Size() == 0 {
+		return nil, 0
+	}
+
+	sourceBytes, err := os.ReadFile(partPath + ".json")
+	if err != nil {
+		return nil, 0
+	}
+
+	var source DownloadSource
+	if err := json.Unmarshal(sourceBytes, &source); err != nil || source.Url != url {
+		return nil, 0
+	}
+
+	return &source, info.Size()
+}
+
+func removePartialDownload(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + ".json")
+}
+
+// Download into <path>.part, resuming it if possible. Hash of the whole of it
+func downloadPart(url string, partPath string) (hash.Hash, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// byte ranges must refer to the file as it is stored
+	req.Header.Set("Accept-Encoding", "identity")
+
+	source, offset := getPartialDownload(url, partPath)
+	if source != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if len(source.ETag) != 0 {
+			req.Header.Set("If-Range", source.ETag)
+		} else if len(source.LastModified) != 0 {
+			req.Header.Set("If-Range", source.LastModified)
+		}
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to perform HTTP GET: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent && source != nil &&
+		strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		log.Printf("resuming download at %.1f MiB\n", float64(offset)/(1<<20))
+	case res.StatusCode == http.StatusOK:
+		offset = 0
+	default:
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			removePartialDownload(partPath)
+		}
+		return nil, fmt.Errorf("HTTP GET: %s", res.Status)
+	}
+
+	hasher := sha256.New()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+
+		// what is already there is hashed first
+		if err := hashFileInto(hasher, partPath); err != nil {
+			return nil, err
+		}
+	} else {
+		source = &DownloadSource{
+			Url:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+		}
+
+		sourceBytes, err := json.Marshal(source)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(partPath+".json", sourceBytes, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	part, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &DownloadProgress{done: offset, total: -1}
+	if res.ContentLength >= 0 {
+		progress.total = offset + res.ContentLength
+	}
+
+	_, err = io.Copy(io.MultiWriter(part, hasher, progress), res.Body)
+
+	progress.print()
+	fmt.Fprintln(os.Stderr)
+
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download interrupted (to be resumed): %w", err)
+	}
+
+	return hasher, nil
+}
+
+func hashFileInto(hasher hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(hasher, f)
+
+	return err
+}
+
+// Decompress (if needed) src into dst, hashing what is written
+func decompressFile(src string, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+
+	defer in.Close()
+
+	reader := bufio.NewReader(in)
+
+	magic, _ := reader.Peek(len(zstdMagic))
+
+	var decompressed io.Reader
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", err
+		}
+		defer gzReader.Close()
+
+		decompressed = gzReader
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return "", err
+		}
+		defer zstdReader.Close()
+
+		decompressed = zstdReader
+	default:
+		return "", nil
+	}
+
+	log.Println("decompressing file...")
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(out, hasher), decompressed)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+
+	return getHexSum(hasher), nil
+}
+
+// Download url into path, if checksum matches (when given)
+func downloadFile(url string, path string, checksum string) error {
+	partPath := path + ".part"
+
+	hasher, err := downloadPart(url, partPath)
+	if err != nil {
+		return err
+	}
+
+	finalPath := partPath
+	sum := getHexSum(hasher)
+
+	decompressedSum, err := decompressFile(partPath, path+".tmp")
+	if err != nil {
+		removePartialDownload(partPath)
+		return fmt.Errorf("unable to decompress: %w", err)
+	}
+	if len(decompressedSum) != 0 {
+		removePartialDownload(partPath)
+		finalPath = path + ".tmp"
+		sum = decompressedSum
+	}
+
+	if len(checksum) != 0 {
+		if sum != checksum {
+			removePartialDownload(partPath)
+			os.Remove(finalPath)
+			return errChecksumMismatch
+		}
+
+		log.Println("checksums match")
+	}
+
+	if err := os.Rename(finalPath, path); err != nil {
+		return err
+	}
+
+	os.Remove(partPath + ".json")
+
+	return nil
+}
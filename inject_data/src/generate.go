@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+/*
+ * Generation only (generate subcommand): tuples, dirty data included, are
+ * written one per line (to --output, stdout by default) exactly as they
+ * would have been sent, as fast as they are read. Nothing is checkpointed.
+ * Along with --manifest and --seed, a reproducible dirty dataset and its
+ * ground truth (see manifest.go)
+ */
+
+const DEFAULT_GENERATE_OUTPUT = "-"
+
+// Number of tuples written
+func generate(ds *Dataset, startAt int32, w io.Writer) (int, error) {
+	var genChans ColumnNoiseGenerationChannels
+
+	genChans.outEntry = make(chan Entry, PARQUET_BATCH_ROWS)
+	genChans.outErr = make(chan error)
+
+	manifest := newManifest(programConfig.generator.manifestPath)
+
+	go readTuplesAndGenerateColumnNoise(ds, startAt, 0, columnNoiseGens, manifest, genChans)
+
+	count := 0
+
+	var writeErr error
+	for entry := range genChans.outEntry {
+		if writeErr != nil {
+			continue // until the reader stops
+		}
+
+		if _, writeErr = io.WriteString(w, entry.tuple+"\n"); writeErr != nil {
+			requestStop()
+			continue
+		}
+
+		count++
+	}
+
+	myErr := <-genChans.outErr
+	close(genChans.outErr)
+
+	if err := manifest.close(); err != nil && myErr == nil {
+		myErr = fmt.Errorf("unable to close manifest %s: %w", manifest.path, err)
+	}
+
+	if writeErr != nil {
+		return count, writeErr
+	}
+
+	if errors.Is(myErr, errInjectionStopped) {
+		return count, nil
+	}
+
+	return count, myErr
+}
+
+func generateMain() {
+	// as fast as they are read
+	programConfig.generator.everyMs = 0
+
+	datasets := getDatasets()
+
+	getDatasetFiles(datasets)
+
+	out := os.Stdout
+	if programConfig.generator.output != DEFAULT_GENERATE_OUTPUT {
+		f, err := os.Create(programConfig.generator.output)
+		if err != nil {
+			log.Fatalf("unable to create %s: %s\n", programConfig.generator.output, err.Error())
+		}
+
+		defer f.Close()
+
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+
+	logNoiseSeed()
+
+	handleSignals()
+
+	startAt := int32(programConfig.injector.startAt)
+	for i := range datasets {
+		log.Printf("generating dataset %s (%d of %d)\n", datasets[i].Name, i+1, len(datasets))
+
+		count, err := generate(&datasets[i], startAt, w)
+		log.Printf("%d tuples generated\n", count)
+		if err != nil {
+			w.Flush()
+			log.Fatalf("generator got an error: %s\n", err.Error())
+		}
+
+		if stopRequested() {
+			break
+		}
+
+		// --start-at refers to the first dataset only
+		startAt = 0
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Fatalf("unable to write tuples: %s\n", err.Error())
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,7 +21,7 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	{
 		columnName: "",
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return "-1"
 			} else {
@@ -27,7 +32,7 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	{
 		columnName: "VendorID",
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.25 {
@@ -39,8 +44,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "tpep_pickup_datetime",
+		critical:   true,
 		callback: func(value string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.8 {
 				return ""
 			}
@@ -56,8 +62,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "tpep_dropoff_datetime",
+		critical:   true,
 		callback: func(value string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			}
@@ -68,8 +75,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "passenger_count",
+		critical:   true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.25 {
@@ -81,8 +89,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "trip_distance",
+		critical:   true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -92,8 +101,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "RatecodeID",
+		critical:   true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.3 {
@@ -106,7 +116,7 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	{
 		columnName: "store_and_fwd_flag",
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.3 {
@@ -118,8 +128,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "PULocationID",
+		critical:   true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.3 {
@@ -131,8 +142,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "DOLocationID",
+		critical:   true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.3 {
@@ -145,7 +157,7 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	{
 		columnName: "payment_type",
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else if num < 0.3 {
@@ -157,8 +169,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "fare_amount",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -168,8 +181,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "extra",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -179,8 +193,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "mta_tax",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -190,8 +205,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "tip_amount",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -201,8 +217,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "tolls_amount",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -212,8 +229,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "improvement_surcharge",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -223,8 +241,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "total_amount",
+		critical:   true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -234,8 +253,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "congestion_surcharge",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -245,8 +265,9 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 	},
 	{
 		columnName: "Airport_fee",
+		amount:     true,
 		callback: func(_ string) string {
-			num := rand.Float32()
+			num := noiseRand.Float32()
 			if num > 0.5 {
 				return ""
 			} else {
@@ -257,21 +278,36 @@ var columnNoiseGens = []ColumnNoiseGenerator{
 }
 
 var tupleWiseNoiseGens = []TupleWiseNoiseGenerator{
-	func(s *string) {
-		*s = strings.ReplaceAll(*s, ",", ";")
+	{
+		name: "separators-replaced",
+		callback: func(s *string) {
+			*s = strings.ReplaceAll(*s, ",", ";")
+		},
 	},
-	func(s *string) {
-		*s += ","
+	{
+		name: "column-appended",
+		callback: func(s *string) {
+			*s += ","
+		},
 	},
-	func(s *string) {
-		*s = "," + *s
+	{
+		name: "column-prepended",
+		callback: func(s *string) {
+			*s = "," + *s
+		},
 	},
-	func(s *string) {
-		*s = ""
+	{
+		name: "emptied",
+		callback: func(s *string) {
+			*s = ""
+		},
 	},
-	func(s *string) {
-		i := strings.LastIndexByte(*s, ',')
-		*s = (*s)[:i] + (*s)[i+1:]
+	{
+		name: "separator-dropped",
+		callback: func(s *string) {
+			i := strings.LastIndexByte(*s, ',')
+			*s = (*s)[:i] + (*s)[i+1:]
+		},
 	},
 }
 
@@ -284,64 +320,368 @@ type ResponseBody struct {
 	//StartDate    uint64 `json:"startDate"`
 }
 
-func inject(path string) error {
-	var genChans ColumnNoiseGenerationChannels
+// Non 2xx answer from the api
+type HttpStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
 
-	genChans.outEntry = make(chan string)
-	genChans.outErr = make(chan error)
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("HTTP status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Connections are reused by the workers
+var httpClient = &http.Client{}
+
+// Progress is printed by every worker, summed up once done
+var progress struct {
+	sync.Mutex
+	start    time.Time
+	sent     int // rows sent at least once
+	injected int // i.e. accepted
+	failed   int // journaled
+	stopped  int // not sent, or not known whether accepted
+}
+
+func countProgress(counter *int) {
+	progress.Lock()
+	defer progress.Unlock()
+
+	*counter++
+}
+
+func printProgress(executionArn string) {
+	progress.Lock()
+	defer progress.Unlock()
+
+	progress.injected++
+	fmt.Printf(" --> Injected %d entries. exec = { arn: %s, start: [...] }\r",
+		progress.injected, executionArn)
+}
+
+func printSummary() {
+	progress.Lock()
+	defer progress.Unlock()
+
+	elapsed := time.Since(progress.start)
+
+	log.Printf("sent %d rows, %d accepted, %d failed, %d left to next run, %.2f rows/s in %v\n",
+		progress.sent, progress.injected, progress.failed, progress.stopped,
+		float64(progress.injected)/elapsed.Seconds(), elapsed.Round(time.Millisecond))
+}
+
+/*
+ * Retries: network errors (timeouts and truncated responses included), HTTP
+ * 408, 429 and 5xx are retried up to --max-retries times, waiting an
+ * exponential backoff with full jitter (or Retry-After, if longer). Other
+ * errors (e.g. local ones building or signing requests, token endpoint
+ * refusals) are not retried at all, rows are journaled right away
+ */
+const RETRY_BASE_DELAY = 500 * time.Millisecond
+const RETRY_MAX_DELAY = 30 * time.Second
+
+func isRetryable(err error) bool {
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) {
+		return isThrottling(statusErr.StatusCode) ||
+			statusErr.StatusCode == http.StatusRequestTimeout
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func getRetryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := RETRY_MAX_DELAY
+	if attempt < 16 {
+		delay = min(RETRY_BASE_DELAY<<attempt, RETRY_MAX_DELAY)
+	}
+
+	delay = time.Duration(rand.Int63n(int64(delay))) + time.Millisecond
 
-	go readTuplesAndGenerateColumnNoise(path, columnNoiseGens, genChans)
+	return max(delay, retryAfter)
+}
+
+// Response body and number of attempts made
+func sendWithRetries(body []byte, limiter *RateLimiter) ([]byte, int, error) {
+	for attempt := 0; ; attempt++ {
+		limiter.wait()
+
+		if attempt == 0 {
+			// not in flight yet, left to next run
+			if stopRequested() {
+				return nil, 0, errInjectionStopped
+			}
+
+			countProgress(&progress.sent)
+		}
+
+		resBodyBytes, err := makeHttpPost(&body)
+		if err == nil {
+			limiter.succeed()
+			return resBodyBytes, attempt + 1, nil
+		}
+
+		var retryAfter time.Duration
+
+		var statusErr *HttpStatusError
+		if errors.As(err, &statusErr) {
+			if isThrottling(statusErr.StatusCode) {
+				limiter.throttle(statusErr.RetryAfter)
+			}
+			retryAfter = statusErr.RetryAfter
+		}
+
+		// aborted by shutdown, unknown whether accepted
+		if errors.Is(err, context.Canceled) {
+			return resBodyBytes, attempt + 1, errInjectionStopped
+		}
+
+		if !isRetryable(err) || attempt >= programConfig.injector.maxRetries {
+			return resBodyBytes, attempt + 1, err
+		}
+
+		delay := getRetryDelay(attempt, retryAfter)
+		log.Printf(" --> HTTP client error (retrying in %v): %s - %s\n",
+			delay.Round(time.Millisecond), string(resBodyBytes), err.Error())
+		if !sleepUnlessOutOfTime(delay) {
+			return resBodyBytes, attempt + 1, errInjectionStopped
+		}
+	}
+}
+
+// False if stopped before knowing whether the row got accepted
+func injectEntry(entry Entry, limiter *RateLimiter, journal *Journal) bool {
+	reqBodyBytes, err := json.Marshal(&RequestBody{Tuple: entry.tuple})
+	if err != nil {
+		log.Printf(" --> Unable to parse JSON (ignoring): %s\n",
+			err.Error())
+		return true
+	}
+
+	resBodyBytes, attempts, err := sendWithRetries(reqBodyBytes, limiter)
+	if errors.Is(err, errInjectionStopped) {
+		return false
+	}
+	if err != nil {
+		countProgress(&progress.failed)
+
+		log.Printf(" --> HTTP client error (row %d journaled): %s - %s\n",
+			entry.index, string(resBodyBytes), err.Error())
+
+		failedRow := FailedRow{
+			Index:    entry.index,
+			Tuple:    entry.tuple,
+			Error:    string(resBodyBytes) + " - " + err.Error(),
+			Attempts: attempts,
+			Time:     time.Now().UTC(),
+		}
+		if err := journal.record(failedRow); err != nil {
+			log.Printf(" --> Unable to journal row %d (lost): %s\n", entry.index, err.Error())
+		}
+		return true
+	}
+
+	smExec := ResponseBody{}
+	if err := json.Unmarshal(resBodyBytes, &smExec); err != nil {
+		log.Printf(" --> Unable to parse JSON (ignoring): %s\n", err)
+	} else {
+		printProgress(smExec.ExecutionArn)
+	}
+
+	return true
+}
+
+/*
+ * Entries are sent by a pool of workers, each one sending a request at a
+ * time, rate limited all together. The reader blocks while every worker is
+ * busy (backpressure), rather than piling entries up
+ */
+func runWorkers(entries <-chan Entry, journal *Journal, checkpoint *Checkpointer) {
+	concurrency := programConfig.injector.concurrency
+
+	httpClient.Transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: concurrency,
+	}
+
+	limiter := newRateLimiter(programConfig.injector.rps, programConfig.injector.burst)
+
+	progress.Lock()
+	progress.start = time.Now()
+	progress.sent, progress.injected, progress.failed, progress.stopped = 0, 0, 0, 0
+	progress.Unlock()
 
 	fmt.Printf(" --> Injected 0 entries\r")
 
-	i := 1
-	for entry := range genChans.outEntry {
-		generateTupleWiseNoise(&entry, &tupleWiseNoiseGens)
-		reqBodyBytes, err := json.Marshal(&RequestBody{Tuple: entry})
-		if err != nil {
-			log.Printf(" --> Unable to parse JSON (ignoring): %s\n",
-				err.Error())
-		} else {
-			resBodyBytes, err := makeHttpPost(&reqBodyBytes)
-			if err != nil {
-				log.Printf(" --> HTTP client error (ignoring): %s - %s\n",
-					string(resBodyBytes), err.Error())
-			} else {
-				smExec := ResponseBody{}
-				if err := json.Unmarshal(resBodyBytes, &smExec); err != nil {
-					log.Printf(" --> Unable to parse JSON (ignoring): %s\n", err)
-				} else {
-					fmt.Printf(" --> Injected %d entries. exec = { arn: %s, start: [...] }\r",
-						i, smExec.ExecutionArn)
-					i++
+	var workers sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for entry := range entries {
+				// sent or journaled, either way never to be sent again
+				if !stopRequested() && injectEntry(entry, limiter, journal) {
+					if checkpoint != nil {
+						checkpoint.ack(entry)
+					}
+					continue
+				}
+
+				countProgress(&progress.stopped)
+
+				// no checkpoint when sending failed rows, back to the journal
+				if checkpoint == nil {
+					stoppedRow := FailedRow{
+						Index: entry.index,
+						Tuple: entry.tuple,
+						Error: errInjectionStopped.Error(),
+						Time:  time.Now().UTC(),
+					}
+					if err := journal.record(stoppedRow); err != nil {
+						log.Printf(" --> Unable to journal row %d (lost): %s\n", entry.index, err.Error())
+					}
 				}
 			}
-		}
+		}()
 	}
 
+	workers.Wait()
+
 	fmt.Println()
 
+	printSummary()
+}
+
+func logJournal(journal *Journal) {
+	if err := journal.close(); err != nil {
+		log.Printf("unable to close journal %s: %s\n", journal.path, err.Error())
+	}
+
+	if journal.count > 0 {
+		log.Printf("%d rows failed, journaled in %s (see --retry-failed)\n",
+			journal.count, journal.path)
+	}
+}
+
+func inject(ds *Dataset) error {
+	var genChans ColumnNoiseGenerationChannels
+
+	genChans.outEntry = make(chan Entry, programConfig.injector.concurrency)
+	genChans.outErr = make(chan error)
+
+	journal := newJournal(programConfig.injector.journalPath)
+
+	checkpoint, err := newCheckpointer(ds.path)
+	if err != nil {
+		return err
+	}
+
+	startAt, startOffset := checkpoint.start(int32(programConfig.injector.startAt))
+
+	manifest := newManifest(programConfig.generator.manifestPath)
+
+	go readTuplesAndGenerateColumnNoise(ds, startAt, startOffset, columnNoiseGens, manifest, genChans)
+
+	runWorkers(genChans.outEntry, journal, checkpoint)
+
 	log.Println("Done")
 
+	logJournal(journal)
+
 	myErr := <-genChans.outErr
 	close(genChans.outErr)
 
+	if err := manifest.close(); err != nil {
+		log.Printf("unable to close manifest %s: %s\n", manifest.path, err.Error())
+	}
+
+	if myErr == nil && !stopRequested() {
+		err = checkpoint.remove()
+	} else {
+		err = checkpoint.save()
+	}
+	if err != nil {
+		log.Printf("unable to update checkpoint: %s\n", err.Error())
+	}
+
+	if errors.Is(myErr, errInjectionStopped) {
+		return nil
+	}
+
 	return myErr
 }
 
+// Send journaled rows again, the ones failing once more are journaled again
+func injectFailed() error {
+	path := programConfig.injector.journalPath
+
+	rows, err := readJournal(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("no failed rows (%s not found)\n", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("retrying %d failed rows from %s\n", len(rows), path)
+
+	// the journal is replaced only once done, being interrupted loses nothing
+	journal := newJournal(path + ".new")
+
+	entries := make(chan Entry, programConfig.injector.concurrency)
+	go func() {
+		for _, row := range rows {
+			entries <- Entry{index: row.Index, tuple: row.Tuple}
+		}
+		close(entries)
+	}()
+
+	runWorkers(entries, journal, nil)
+
+	log.Println("Done")
+
+	if err := journal.close(); err != nil {
+		return err
+	}
+
+	if journal.count == 0 {
+		log.Println("all of the failed rows have been sent")
+		return os.Remove(path)
+	}
+
+	journal.path = path
+	logJournal(journal)
+
+	return os.Rename(path+".new", path)
+}
+
 func makeHttpPost(body *[]byte) ([]byte, error) {
 	url := programConfig.injector.http.apiEndpoint + "/store"
 
-	httpClient := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(*body))
+	req, err := http.NewRequestWithContext(shutdown.ctx, "POST", url, bytes.NewBuffer(*body))
 	if err != nil {
 		return []byte("request builder"), err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 
-	if len(programConfig.injector.http.authKey) != 0 {
-		req.Header.Add("Authorization", programConfig.injector.http.authKey)
+	if useJwt() {
+		accessToken, err := getAccessToken()
+		if err != nil {
+			return []byte("access token"), err
+		}
+
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+	} else if len(programConfig.injector.http.authKey) != 0 {
+		if programConfig.injector.http.sign {
+			if err := signRequest(req, *body); err != nil {
+				return []byte("request signer"), err
+			}
+		} else {
+			req.Header.Add("Authorization", programConfig.injector.http.authKey)
+		}
 	}
 
 	res, err := httpClient.Do(req)
@@ -356,5 +696,12 @@ func makeHttpPost(body *[]byte) ([]byte, error) {
 		return []byte("response body buffer reader"), err
 	}
 
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return resBody, &HttpStatusError{
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+
 	return resBody, nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Journal of failed rows
+ *
+ * Rows which could not be sent (non retryable error, or still failing after
+ * --max-retries) are appended to the journal, one JSON object per line,
+ * exactly as they were sent (noise included). --retry-failed sends them
+ * again, rows failing once more end up in the journal again
+ */
+
+type FailedRow struct {
+	Index    int32     `json:"index"`
+	Tuple    string    `json:"tuple"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+type Journal struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	count int
+}
+
+// File is created on first failed row only
+func newJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+func (j *Journal) record(row FailedRow) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		j.file = file
+	}
+
+	rowBytes, err := json.Marshal(&row)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.file.Write(append(rowBytes, '\n')); err != nil {
+		return err
+	}
+
+	j.count++
+
+	return nil
+}
+
+func (j *Journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+
+	err := j.file.Close()
+	j.file = nil
+
+	return err
+}
+
+func readJournal(path string) ([]FailedRow, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var rows []FailedRow
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var row FailedRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
@@ -1,314 +1,124 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const DEFAULT_CSV_SEPARATOR = ","
+const DEFAULT_CSV_HEADER = CSV_HEADER_FIRST
+const DEFAULT_CSV_MALFORMED = CSV_MALFORMED_SKIP
+
+// auto: parquet if filename ends with .parquet, csv otherwise
+const INPUT_FORMAT_AUTO = "auto"
+const INPUT_FORMAT_CSV = "csv"
+const INPUT_FORMAT_PARQUET = "parquet"
+const DEFAULT_INPUT_FORMAT = INPUT_FORMAT_AUTO
+
+var inputFormats = []string{INPUT_FORMAT_AUTO, INPUT_FORMAT_CSV, INPUT_FORMAT_PARQUET}
 
 const DEFAULT_API_ENDPOINT = "https://serhvvbg7c.execute-api.us-east-1.amazonaws.com"
 const DEFAULT_AUTH_KEY = ""
+const DEFAULT_CLIENT_ID = "default"
+
+// written (within default cachedir) by "deploy status -save", if present
+// API endpoint is taken from there instead of DEFAULT_API_ENDPOINT
+const DEFAULT_OUTPUTS_FILE_NAME = "deploy_outputs.json"
 
 const DEFAULT_START_AT = "0"
 
+const DEFAULT_CONCURRENCY = "1"
+const DEFAULT_RPS = "0"
+const DEFAULT_BURST = "1"
+const DEFAULT_MAX_RETRIES = "3"
+
+// within cachedir, unless --failed-journal given
+const DEFAULT_JOURNAL_FILE_NAME = "failed_rows.jsonl"
+
 const DEFAULT_EVERY_MS = "3000"
 const DEFAULT_DIRTY_DATA = "true"
 const DEFAULT_DIRTY_THRESHOLD = "0.8"
 
 const DEFAULT_CACHEDIR_RELNAME = ".sdcc_dinj_cache/"
-const DEFAULT_FILE_NAME = "nyc_yellowtaxis_feb2024.csv"
 const DEFAULT_SKIP_CHECKSUM = false
 const DEFAULT_SKIP_DOWNLOAD = false
-const EXPECTED_FILE_SHA256_CHECKSUM = "D22A63D4EE390D4375F3EAC901FD5C4B5FDB938786E7E4D5294893B1B43B75E9"
-const DEFAULT_URL = "https://drive.usercontent.google.com/download?id=1mqkh5NOnXcPbMaDtlQwbqAohh2hmwD9A&" +
-	"export=download&authuser=0&confirm=t&uuid=e9f71f77-81ff-43a9-8a61-3b5c7e707aa1&" +
-	"at=APZUnTVXgI56OrhPdA_2E6QDCYca%3A1714139639065"
 
 type Config struct {
-	filename     string
+	configPath   string // see cli.go
+	outputsPath  string // deploy outputs, see loadDeployOutputs
 	cacheDirPath string
-	checksum     string
-	downloadUrl  string
 	skipChecksum bool
 	skipDownload bool
 
+	// datasets to inject, see catalog.go
+	datasets     []string // catalog names (patterns)
+	inputs       []string // local files, directories or patterns
+	catalogPath  string
+	listDatasets bool
+
+	// overriding those of the (single) catalog dataset, if given
+	filename    string
+	checksum    string
+	downloadUrl string
+
+	inputFormat    string
+	parquetColumns []string // see parquet_reader.go
+
 	generator struct {
-		dirtyThresh float32
-		dirtyData   bool
-		everyMs     int
+		dirtyThresh  float64
+		dirtyData    bool
+		everyMs      int
+		seed         uint64 // random unless given, see cngen.go
+		manifestPath string // see manifest.go
+		output       string // see generate.go
 	}
 
 	injector struct {
 		http struct {
-			apiEndpoint string
-			authKey     string
+			apiEndpoint  string
+			authKey      string
+			authRequired bool
+			sign         bool // HMAC signed requests, see signer.go
+			clientId     string
+
+			// JWT authorization, see oauth.go
+			issuer        string
+			tokenEndpoint string
+			clientSecret  string
+			scope         string
+			audience      string
 		}
-		startAt int32
+		startAt     int
+		resume      bool // from last checkpoint, see checkpoint.go
+		concurrency int
+		rps         float64 // 0: unlimited
+		burst       int
+
+		// failed rows, see journal.go
+		maxRetries  int
+		journalPath string
+		retryFailed bool
+
+		drainTimeout time.Duration // see shutdown.go
 	}
 
 	csv struct {
 		separator string
+		header    string   // see csv_parser.go
+		columns   []string // names, unless taken from header
+		malformed string   // policy for malformed lines
 	}
 }
 
-type Argument struct {
-	name        string
-	description string
-	needsValue  bool
-	handler     func(string)
-	defValue    string
-}
-
 var programConfig Config
-var programArguments = []Argument{
-	{
-		name:        "--checksum",
-		description: "Enable custom checksum value verification (SHA256)",
-		needsValue:  true,
-		defValue:    EXPECTED_FILE_SHA256_CHECKSUM,
-		handler: func(val string) {
-			programConfig.checksum = val
-			programConfig.skipChecksum = false
-			if len(programConfig.checksum) != 64 {
-				log.Fatalf("SHA256 checksum hex-encoded strings " +
-					"(base64 encoded) must be exactly 64 char long")
-			}
-		},
-	},
-	{
-		name:        "--skip-checksum",
-		description: "Disable checksum verification",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.skipChecksum = true
-		},
-	},
-	{
-		name:        "--checksum-default",
-		description: "Enable default checksum value verification (SHA256)",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.checksum = EXPECTED_FILE_SHA256_CHECKSUM
-			programConfig.skipChecksum = false
-		},
-	},
-	{
-		name:        "--filename",
-		description: "Set custom relative (to cachedir) filename to use",
-		needsValue:  true,
-		defValue:    DEFAULT_FILE_NAME,
-		handler: func(val string) {
-			programConfig.filename = val
-		},
-	},
-	{
-		name:        "--filename-default",
-		description: "Set default relative (to cachedir) filename to use",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.filename = DEFAULT_FILE_NAME
-		},
-	},
-	{
-		name:        "--cachedir",
-		description: "Set custom cache directory",
-		needsValue:  true,
-		defValue:    DEFAULT_CACHEDIR_RELNAME,
-		handler: func(val string) {
-			programConfig.cacheDirPath = val
-		},
-	},
-	{
-		name:        "--cachedir-default",
-		description: "Set default cache directory",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.cacheDirPath = DEFAULT_CACHEDIR_RELNAME
-		},
-	},
-	{
-		name:        "--download",
-		description: "Enable downloading required file by custom URL",
-		needsValue:  true,
-		defValue:    DEFAULT_URL,
-		handler: func(val string) {
-			programConfig.downloadUrl = val
-			programConfig.skipDownload = false
-		},
-	},
-	{
-		name:        "--download-default",
-		description: "Enable downloading required file by default URL",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.downloadUrl = DEFAULT_URL
-			programConfig.skipDownload = false
-		},
-	},
-	{
-		name:        "--skip-download",
-		description: "Disable downloading required file",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.skipDownload = true
-		},
-	},
-	{
-		name:        "--every-ms",
-		description: "Generate an entry every X ms",
-		needsValue:  true,
-		defValue:    DEFAULT_EVERY_MS,
-		handler: func(value string) {
-			evMs, err := strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				log.Fatalln("unable to parse int")
-			}
-
-			programConfig.generator.everyMs = int(evMs)
-		},
-	},
-	{
-		name:        "--every-ms-default",
-		description: "Generate an entry every default ms delay",
-		needsValue:  false,
-		handler: func(_ string) {
-			evMs, _ := strconv.ParseInt(DEFAULT_EVERY_MS, 10, 32)
-			programConfig.generator.everyMs = int(evMs)
-		},
-	},
-	{
-		name:        "--dirty-data",
-		description: "Enable generation of dirty data (random)",
-		needsValue:  false,
-		defValue:    DEFAULT_DIRTY_DATA,
-		handler: func(_ string) {
-			programConfig.generator.dirtyData = true
-		},
-	},
-	{
-		name:        "--no-dirty-data",
-		description: "Disable generation of dirty data (random)",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.generator.dirtyData = false
-		},
-	},
-	{
-		name:        "--dirty-thresh",
-		description: "Set thresh. to dirty data. Check against PRNG-generated num in (0,1).",
-		needsValue:  true,
-		defValue:    DEFAULT_DIRTY_THRESHOLD,
-		handler: func(value string) {
-			dThr, err := strconv.ParseFloat(value, 32)
-			if err != nil {
-				log.Fatalln("unable to parse float")
-			}
-
-			programConfig.generator.dirtyThresh = float32(dThr)
-		},
-	},
-	{
-		name:        "--dirty-thresh-default",
-		description: "Set thresh. to dirty data (default). Check against PRNG-generated num in (0,1).",
-		needsValue:  false,
-		handler: func(_ string) {
-			dThr, _ := strconv.ParseFloat(DEFAULT_DIRTY_THRESHOLD, 32)
-			programConfig.generator.dirtyThresh = float32(dThr)
-		},
-	},
-	{
-		name:        "--api-endpoint",
-		description: "Set API gateway endpoint to send data to",
-		needsValue:  true,
-		defValue:    DEFAULT_API_ENDPOINT,
-		handler: func(value string) {
-			programConfig.injector.http.apiEndpoint = value
-		},
-	},
-	{
-		name:        "--api-endpoint-default",
-		description: "Set default API gateway endpoint to send data to",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.injector.http.apiEndpoint = DEFAULT_API_ENDPOINT
-		},
-	},
-	{
-		name:        "--csv-separator",
-		description: "Set custom csv column separator",
-		needsValue:  true,
-		defValue:    DEFAULT_CSV_SEPARATOR,
-		handler: func(value string) {
-			if len(value) != 1 {
-				log.Fatalf("%s is not a valid separator - must be 1 chr long\n",
-					value)
-			}
-			programConfig.csv.separator = value
-		},
-	},
-	{
-		name:        "--csv-separator-default",
-		description: "Set default csv column separator",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.csv.separator = DEFAULT_CSV_SEPARATOR
-		},
-	},
-	{
-		name:        "--auth-key",
-		description: "Enable authentication via secret key",
-		needsValue:  true,
-		defValue:    DEFAULT_AUTH_KEY,
-		handler: func(value string) {
-			programConfig.injector.http.authKey = value
-		},
-	},
-	{
-		name:        "--no-auth-key",
-		description: "Disable authentication",
-		needsValue:  false,
-		handler: func(_ string) {
-			programConfig.injector.http.authKey = DEFAULT_START_AT
-		},
-	},
-	{
-		name:        "--start-at",
-		description: "Start injecting from i-th entry",
-		needsValue:  true,
-		defValue:    DEFAULT_START_AT,
-		handler: func(value string) {
-			s, err := strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				log.Fatalln("unable to parse int")
-			}
-
-			if s >= 0 {
-				programConfig.injector.startAt = int32(s)
-			} else {
-				log.Fatalln("invalid value for --start-at")
-			}
-		},
-	},
-	{
-		name:        "--start-at-default",
-		description: "Set default starting point for entry injection",
-		needsValue:  false,
-		handler: func(_ string) {
-			s, _ := strconv.ParseInt(DEFAULT_START_AT, 10, 32)
-			programConfig.injector.startAt = int32(s)
-		},
-	},
-}
 
 func getFwdPathSep(path string) string {
 	return strings.ReplaceAll(path, "\\", "/")
@@ -323,74 +133,117 @@ func getHomeDir() string {
 	return home
 }
 
-func printHelpAndExit() {
-	for _, arg := range programArguments {
-		fmt.Printf(" * %s - %s, needs value: %t\n",
-			arg.name, arg.description, arg.needsValue)
-		if arg.defValue != "" {
-			fmt.Printf("  \tdefault: %s\n", arg.defValue)
-		}
-	}
-
-	os.Exit(0)
-}
-
 func loadDefaults() {
 	dirtyData, _ := strconv.ParseBool(DEFAULT_DIRTY_DATA)
-	dirtyThresh, _ := strconv.ParseFloat(DEFAULT_DIRTY_THRESHOLD, 32)
+	dirtyThresh, _ := strconv.ParseFloat(DEFAULT_DIRTY_THRESHOLD, 64)
 	evMs, _ := strconv.ParseInt(DEFAULT_EVERY_MS, 10, 32)
-	startAt, _ := strconv.ParseInt(DEFAULT_START_AT, 10, 32)
+	startAt, _ := strconv.Atoi(DEFAULT_START_AT)
+	concurrency, _ := strconv.Atoi(DEFAULT_CONCURRENCY)
+	rps, _ := strconv.ParseFloat(DEFAULT_RPS, 64)
+	burst, _ := strconv.Atoi(DEFAULT_BURST)
+	maxRetries, _ := strconv.Atoi(DEFAULT_MAX_RETRIES)
+	drainTimeout, _ := time.ParseDuration(DEFAULT_DRAIN_TIMEOUT)
 
 	dflCacheDir := getHomeDir() + "/" + DEFAULT_CACHEDIR_RELNAME
 
-	programConfig.filename = DEFAULT_FILE_NAME
+	programConfig.inputFormat = DEFAULT_INPUT_FORMAT
 	programConfig.cacheDirPath = dflCacheDir
-	programConfig.checksum = EXPECTED_FILE_SHA256_CHECKSUM
-	programConfig.downloadUrl = DEFAULT_URL
 	programConfig.skipChecksum = DEFAULT_SKIP_CHECKSUM
 	programConfig.skipDownload = DEFAULT_SKIP_DOWNLOAD
 	programConfig.injector.http.apiEndpoint = DEFAULT_API_ENDPOINT
 	programConfig.injector.http.authKey = DEFAULT_AUTH_KEY
-	programConfig.injector.startAt = int32(startAt)
+	programConfig.injector.http.clientId = DEFAULT_CLIENT_ID
+	programConfig.injector.http.scope = DEFAULT_SCOPE
+	programConfig.injector.startAt = startAt
+	programConfig.injector.resume = true
+	programConfig.injector.concurrency = concurrency
+	programConfig.injector.rps = rps
+	programConfig.injector.burst = burst
+	programConfig.injector.maxRetries = maxRetries
+	programConfig.injector.drainTimeout = drainTimeout
 	programConfig.generator.dirtyData = dirtyData
-	programConfig.generator.dirtyThresh = float32(dirtyThresh)
+	programConfig.generator.dirtyThresh = dirtyThresh
 	programConfig.generator.everyMs = int(evMs)
 
 	programConfig.csv.separator = DEFAULT_CSV_SEPARATOR
+	programConfig.csv.header = DEFAULT_CSV_HEADER
+	programConfig.csv.malformed = DEFAULT_CSV_MALFORMED
+
+	outputsFile := dflCacheDir + "/" + DEFAULT_OUTPUTS_FILE_NAME
+	if _, err := os.Stat(outputsFile); err == nil {
+		if err := loadDeployOutputs(outputsFile); err != nil {
+			log.Printf("ignoring deploy outputs %s: %s\n", outputsFile, err.Error())
+		}
+	}
 }
 
-func configureProgramByArgs() {
-	loadDefaults()
+// Only what the injector needs out of deploy status
+type DeployOutputs struct {
+	ApiEndpoint string `json:"apiEndpoint"`
+	Authorizer  struct {
+		Enabled bool   `json:"enabled"`
+		Mode    string `json:"mode"`
+		Issuer  string `json:"issuer"`
+	} `json:"authorizer"`
+}
 
-	args := os.Args
+func loadDeployOutputs(path string) error {
+	outputsBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < len(args); i++ {
-		if args[i] == "--help" {
-			printHelpAndExit()
-		}
+	var outputs DeployOutputs
+	if err := json.Unmarshal(outputsBytes, &outputs); err != nil {
+		return err
 	}
 
-	for i := 1; i < len(args); i++ {
-		matchingArgFound := false
-		for _, arg := range programArguments {
-			if args[i] == arg.name {
-				matchingArgFound = true
-				if arg.needsValue {
-					i++
-					if i == len(args) {
-						log.Fatalf("argument %s requires value!\n", args[i-1])
-					}
-				}
-				arg.handler(args[i])
-				break
-			}
-		}
-		if !matchingArgFound {
-			log.Printf("ignoring unknown cmdline opt %s\n", args[i])
-		}
+	if len(outputs.ApiEndpoint) == 0 {
+		return fmt.Errorf("no api endpoint (is the pipeline deployed?)")
 	}
 
-	uniformConfigParameters()
+	// options given explicitly win
+	if !isFlagSet("api-endpoint") {
+		programConfig.injector.http.apiEndpoint = outputs.ApiEndpoint
+	}
+	programConfig.injector.http.authRequired = outputs.Authorizer.Enabled
+	if !isFlagSet("sign") {
+		programConfig.injector.http.sign = outputs.Authorizer.Mode == AUTH_MODE_HMAC
+	}
+	if outputs.Authorizer.Mode == AUTH_MODE_JWT && !isFlagSet("issuer") {
+		programConfig.injector.http.issuer = outputs.Authorizer.Issuer
+	}
+
+	log.Printf("api endpoint %s taken from deploy outputs %s\n", outputs.ApiEndpoint, path)
+
+	return nil
+}
+
+func validateConfig() error {
+	switch {
+	case len(programConfig.checksum) != 0 && len(programConfig.checksum) != 64:
+		return fmt.Errorf("SHA256 checksum hex-encoded strings must be exactly 64 char long")
+	case len(programConfig.csv.separator) != 1 || strings.ContainsAny(programConfig.csv.separator, "\"\r\n"):
+		return fmt.Errorf("%s is not a valid separator - must be 1 chr long", programConfig.csv.separator)
+	case programConfig.injector.startAt < 0 || programConfig.injector.startAt > math.MaxInt32:
+		return fmt.Errorf("invalid value for --start-at")
+	case programConfig.generator.everyMs < 0:
+		return fmt.Errorf("invalid value for --every-ms")
+	case programConfig.generator.dirtyThresh < 0 || programConfig.generator.dirtyThresh > 1:
+		return fmt.Errorf("invalid value for --dirty-thresh, must be within 0 and 1")
+	case programConfig.injector.concurrency < 1:
+		return fmt.Errorf("invalid value for --concurrency")
+	case programConfig.injector.rps < 0:
+		return fmt.Errorf("invalid value for --rps")
+	case programConfig.injector.burst < 1:
+		return fmt.Errorf("invalid value for --burst")
+	case programConfig.injector.maxRetries < 0:
+		return fmt.Errorf("invalid value for --max-retries")
+	case programConfig.injector.drainTimeout < 0:
+		return fmt.Errorf("invalid value for --drain-timeout")
+	}
+
+	return nil
 }
 
 func uniformConfigParameters() {
@@ -398,19 +251,23 @@ func uniformConfigParameters() {
 	programConfig.cacheDirPath, _ = filepath.Abs(programConfig.cacheDirPath)
 	programConfig.filename = getFwdPathSep(programConfig.filename)
 	programConfig.cacheDirPath = getFwdPathSep(programConfig.cacheDirPath)
+
+	if len(programConfig.injector.journalPath) == 0 {
+		programConfig.injector.journalPath = programConfig.cacheDirPath + "/" + DEFAULT_JOURNAL_FILE_NAME
+	}
 }
 
-func checkFile() (string, bool) {
-	fpath := programConfig.cacheDirPath + "/" + programConfig.filename
+func checkFile(filename string) (string, bool) {
+	fpath := programConfig.cacheDirPath + "/" + filename
 
-	if filepath.IsAbs(programConfig.filename) {
-		dir, _ := path.Split(programConfig.filename)
+	if filepath.IsAbs(filename) {
+		dir, _ := path.Split(filename)
 		if path.Clean(dir) != programConfig.cacheDirPath {
 			log.Fatalln("basedir is different from cachedir")
 		}
 
-		fpath = programConfig.filename
-	} else if strings.Contains(programConfig.filename, "/") {
+		fpath = filename
+	} else if strings.Contains(filename, "/") {
 		log.Println("if filename value is something like \"./file.txt\" or \".\\file.txt\"")
 		log.Println("then try replacing it like \"file.txt\" (basic path checks implemented)")
 		log.Fatalln("no subdirectories in cachedir allowed")
@@ -423,107 +280,188 @@ func checkFile() (string, bool) {
 	return fpath, !os.IsNotExist(err)
 }
 
-func sha256Checksum(path string) string {
-	fileBytes, err := os.ReadFile(path)
-	if err != nil {
-		return "failfailfail"
+// From the first url that works (and matches checksum, if any)
+func fileDownload(urls []string, path string, checksum string) {
+	for _, url := range urls {
+		err := downloadFile(url, path, checksum)
+		if err == nil {
+			return
+		}
+
+		log.Printf("download from %s failed: %s\n", url, err.Error())
 	}
 
-	hasher := sha256.New()
-	if _, err := hasher.Write(fileBytes); err != nil {
-		return "failfailfail"
+	log.Fatalln("unable to download file")
+}
+
+// Dataset file, downloaded (and verified) into cachedir if needed
+func getDatasetFile(ds *Dataset) string {
+	checksum := strings.ToUpper(ds.Sha256)
+	if programConfig.skipChecksum {
+		checksum = ""
+	}
+
+	myFilePath, myFileExists := checkFile(ds.getFilename())
+
+	if myFileExists {
+		if len(checksum) == 0 {
+			return myFilePath // SUCCESS
+		}
+
+		if sha256Checksum(myFilePath) == checksum {
+			log.Println("checksums match")
+			return myFilePath // SUCCESS
+		}
+
+		log.Println("user requested checksum verification")
+		log.Println("checksums do not match")
+		if programConfig.skipDownload {
+			log.Fatalln("terminating now") //EXITING
+		}
+
+		if err := os.Remove(myFilePath); err != nil {
+			log.Fatalf("unable to remove file %s: %s\n", myFilePath, err.Error())
+		}
+	} else if programConfig.skipDownload {
+		log.Println("user requested not to download anything")
+		log.Fatalln("terminating now")
 	}
 
-	hexStr := hex.EncodeToString(hasher.Sum(nil))
-	return strings.ToUpper(hexStr)
+	log.Println("downloading file...")
+	fileDownload(ds.Urls, myFilePath, checksum)
+
+	return myFilePath
 }
 
-func fileDownload(path string) {
-	res, err := http.Get(programConfig.downloadUrl)
+// Selected datasets, with cmdline overrides applied
+func getDatasets() []Dataset {
+	datasets, err := getSelectedDatasets()
 	if err != nil {
-		log.Fatalf("unable to perform HTTP GET: %s\n",
-			err.Error())
+		log.Fatalf("unable to select datasets: %s\n", err.Error())
 	}
 
-	body := res.Body
-	defer body.Close()
+	overrides := len(programConfig.filename) != 0 || len(programConfig.checksum) != 0 ||
+		len(programConfig.downloadUrl) != 0
+	if overrides && len(datasets) != 1 {
+		log.Fatalln("--filename, --checksum and --download require a single --dataset")
+	}
 
-	bodyBytes, err := io.ReadAll(body)
-	if err != nil {
-		log.Fatalf("unable to read body buffer: %s\n",
-			err.Error())
+	for i := range datasets {
+		if len(programConfig.filename) != 0 {
+			datasets[i].Filename = programConfig.filename
+		}
+		if len(programConfig.checksum) != 0 {
+			datasets[i].Sha256 = programConfig.checksum
+		}
+		if len(programConfig.downloadUrl) != 0 {
+			datasets[i].Urls = []string{programConfig.downloadUrl}
+		}
 	}
 
-	if err = os.WriteFile(path, bodyBytes, 0644); err != nil {
-		log.Fatalf("unable to write file: %s\n",
-			err.Error())
+	return datasets
+}
+
+// Every dataset is there (downloaded if needed) before anything gets done
+func getDatasetFiles(datasets []Dataset) {
+	for i := range datasets {
+		if !datasets[i].local {
+			datasets[i].path = getDatasetFile(&datasets[i])
+		}
 	}
 }
 
-func main() {
-	configureProgramByArgs()
+func injectMain() {
+	if useJwt() {
+		if len(programConfig.injector.http.clientSecret) == 0 {
+			log.Println("WARNING jwt authorization enabled, but no --client-secret given")
+		}
+	} else if programConfig.injector.http.authRequired &&
+		len(programConfig.injector.http.authKey) == 0 {
+		log.Println("WARNING deployed api requires authentication, but no --auth-key given")
+	}
 
-	err := os.MkdirAll(programConfig.cacheDirPath, 0700)
-	if err != nil {
-		log.Fatalf("unable to create directory %s: %s\n",
-			programConfig.cacheDirPath, err.Error())
+	if programConfig.injector.retryFailed {
+		handleSignals()
+
+		if err := injectFailed(); err != nil {
+			log.Fatalf("unable to retry failed rows: %s\n", err.Error())
+		}
+		return
 	}
 
-	log.Printf("cachedir %s ok\n", programConfig.cacheDirPath)
+	datasets := getDatasets()
+
+	getDatasetFiles(datasets)
+
+	logNoiseSeed()
+
+	handleSignals()
+
+	for i := range datasets {
+		log.Printf("injecting dataset %s (%d of %d)\n", datasets[i].Name, i+1, len(datasets))
+
+		injectErr := inject(&datasets[i])
+		if injectErr != nil {
+			log.Fatalf("injector got an error: %s\n",
+				injectErr.Error())
+		}
 
-	var fullFilePath string
-
-	attempt := 1
-	for attempt <= 2 {
-
-		myFilePath, myFileExists := checkFile()
-
-		if myFileExists {
-			if !programConfig.skipChecksum {
-				if sha256Checksum(myFilePath) != programConfig.checksum {
-					log.Println("user requested checksum verification")
-					log.Println("checksums do not match")
-					if !programConfig.skipDownload {
-						if os.Remove(myFilePath) != nil {
-							log.Fatalf("unable to remove file %s: %s\n",
-								myFilePath, err.Error())
-						}
-
-						attempt++
-					} else {
-						log.Fatalln("terminating now") //EXITING
-					}
-				} else {
-					log.Println("checksums match")
-					fullFilePath = myFilePath
-					break // SUCCESS
-				}
-			} else {
-				fullFilePath = myFilePath
-				break // SUCCESS
-			}
-		} else {
-			if programConfig.skipDownload {
-				log.Println("user requested not to download anything")
-				log.Fatalln("terminating now")
-			} else {
-				log.Println("downloading file...")
-				fileDownload(myFilePath)
-				if programConfig.skipChecksum {
-					attempt++
-				}
-			}
+		if stopRequested() {
+			break
 		}
+
+		// --start-at refers to the first dataset only
+		programConfig.injector.startAt = 0
 	}
+}
 
-	if attempt > 2 {
-		log.Println("max attempts reached")
-		log.Fatalln("terminating now")
+func downloadMain() {
+	getDatasetFiles(getDatasets())
+}
+
+// Exit status 1 if any dataset is missing or does not match its checksum
+func verifyMain() {
+	failed := 0
+
+	for _, ds := range getDatasets() {
+		status := "ok"
+
+		myFilePath, myFileExists := checkFile(ds.getFilename())
+		if !myFileExists {
+			status = "missing"
+			failed++
+		} else if sha256Checksum(myFilePath) != strings.ToUpper(ds.Sha256) {
+			status = "checksums do not match"
+			failed++
+		}
+
+		fmt.Printf("%-24s %s\n", ds.Name, status)
 	}
 
-	injectErr := inject(fullFilePath)
-	if injectErr != nil {
-		log.Fatalf("injector got an error: %s\n",
-			injectErr.Error())
+	if failed > 0 {
+		log.Fatalf("%d datasets failed verification\n", failed)
 	}
 }
+
+func main() {
+	sc, args := getSubcommand(os.Args[1:])
+
+	parseCmdline(sc, args)
+
+	if programConfig.listDatasets {
+		if err := listDatasets(); err != nil {
+			log.Fatalf("unable to list datasets: %s\n", err.Error())
+		}
+		return
+	}
+
+	err := os.MkdirAll(programConfig.cacheDirPath, 0700)
+	if err != nil {
+		log.Fatalf("unable to create directory %s: %s\n",
+			programConfig.cacheDirPath, err.Error())
+	}
+
+	log.Printf("cachedir %s ok\n", programConfig.cacheDirPath)
+
+	sc.run()
+}
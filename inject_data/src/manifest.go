@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+/*
+ * Ground truth of dirty data (--manifest)
+ *
+ * Every tuple generated is recorded, one JSON object per line: dataset and
+ * row index (as --start-at), noise seed, the noise it got (columns and their
+ * dirty values, tuple-wise noise) and the outcome of validation expected,
+ * i.e. whether the validate lambda should reject it or accept it (dirty
+ * values of non-critical columns blanked). Source rows are assumed to be
+ * valid, only the noise injected is accounted for. Records are appended,
+ * those of rows generated again (resuming) being identical (see --seed)
+ */
+
+const EXPECTED_ACCEPTED = "accepted"
+const EXPECTED_REJECTED = "rejected"
+
+type ColumnNoise struct {
+	Column string `json:"column"`
+	Index  int    `json:"index"`
+	Value  string `json:"value"`
+
+	critical bool
+	amount   bool
+}
+
+type ManifestRecord struct {
+	Dataset    string        `json:"dataset"`
+	Index      int32         `json:"index"`
+	Seed       uint64        `json:"seed"`
+	Dirty      bool          `json:"dirty"`
+	Noise      []ColumnNoise `json:"noise,omitempty"`
+	TupleNoise string        `json:"tupleNoise,omitempty"`
+	Malformed  bool          `json:"malformed,omitempty"` // sent raw, see --csv-malformed
+	Expected   string        `json:"expected"`
+	Tuple      string        `json:"tuple"`
+}
+
+type Manifest struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	count  int
+}
+
+// File is created on first record only, none at all if no path
+func newManifest(path string) *Manifest {
+	if len(path) == 0 {
+		return nil
+	}
+
+	return &Manifest{path: path}
+}
+
+// As per the checks of the validate lambda (see ../../lambdas/validate)
+func getExpectedOutcome(rec *ManifestRecord) string {
+	if rec.Malformed || len(rec.TupleNoise) != 0 {
+		return EXPECTED_REJECTED
+	}
+
+	amountChanged := false
+	amountBlanked := false
+	for _, noise := range rec.Noise {
+		if noise.critical {
+			return EXPECTED_REJECTED
+		}
+
+		if noise.amount {
+			if _, err := strconv.ParseFloat(noise.Value, 64); err == nil {
+				amountChanged = true
+			} else {
+				amountBlanked = true
+			}
+		}
+	}
+
+	// total_amount is checked against the other amounts only if all of
+	// them are numbers
+	if amountChanged && !amountBlanked {
+		return EXPECTED_REJECTED
+	}
+
+	return EXPECTED_ACCEPTED
+}
+
+// Not safe for concurrent use, records come from the generator only
+func (m *Manifest) record(rec ManifestRecord) error {
+	if m == nil {
+		return nil
+	}
+
+	if m.file == nil {
+		file, err := os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		m.file = file
+		m.writer = bufio.NewWriter(file)
+	}
+
+	rec.Dirty = len(rec.Noise) != 0 || len(rec.TupleNoise) != 0
+	rec.Expected = getExpectedOutcome(&rec)
+
+	recBytes, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.writer.Write(append(recBytes, '\n')); err != nil {
+		return err
+	}
+
+	m.count++
+
+	return nil
+}
+
+func (m *Manifest) close() error {
+	if m == nil || m.file == nil {
+		return nil
+	}
+
+	err := m.writer.Flush()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.file = nil
+
+	return err
+}
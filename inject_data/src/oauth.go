@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * JWT authorization (deploy -auth-mode jwt)
+ *
+ * Access tokens are obtained via OAuth2 client credentials grant (client
+ * id and secret sent as HTTP basic auth) against the token endpoint, either
+ * given or discovered from the issuer (OpenID configuration). A token is
+ * reused until shortly before it expires
+ */
+
+const AUTH_MODE_JWT = "jwt"
+const DEFAULT_SCOPE = "pipeline:ingest"
+const TOKEN_EXPIRY_MARGIN = 30 * time.Second
+
+// When the token endpoint does not tell (expires_in is optional)
+const DEFAULT_TOKEN_LIFETIME = 5 * time.Minute
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+var tokenCache struct {
+	sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func useJwt() bool {
+	return len(programConfig.injector.http.tokenEndpoint) != 0 ||
+		len(programConfig.injector.http.issuer) != 0
+}
+
+// Token endpoint as advertised by the issuer
+func discoverTokenEndpoint(issuer string) (string, error) {
+	res, err := http.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("openid configuration: %s", res.Status)
+	}
+
+	var oidcConfig struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&oidcConfig); err != nil {
+		return "", err
+	}
+
+	if len(oidcConfig.TokenEndpoint) == 0 {
+		return "", fmt.Errorf("no token endpoint advertised by %s", issuer)
+	}
+
+	return oidcConfig.TokenEndpoint, nil
+}
+
+func requestToken(tokenEndpoint string) (*TokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(programConfig.injector.http.scope) != 0 {
+		form.Set("scope", programConfig.injector.http.scope)
+	}
+	if len(programConfig.injector.http.audience) != 0 {
+		form.Set("audience", programConfig.injector.http.audience)
+	}
+
+	req, err := http.NewRequest("POST", tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(programConfig.injector.http.clientId),
+		url.QueryEscape(programConfig.injector.http.clientSecret))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s - %s", res.Status, string(resBody))
+	}
+
+	var token TokenResponse
+	if err := json.Unmarshal(resBody, &token); err != nil {
+		return nil, err
+	}
+
+	if len(token.AccessToken) == 0 {
+		return nil, fmt.Errorf("token endpoint: no access token")
+	}
+
+	return &token, nil
+}
+
+func getAccessToken() (string, error) {
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	if len(tokenCache.accessToken) != 0 && time.Now().Before(tokenCache.expiresAt) {
+		return tokenCache.accessToken, nil
+	}
+
+	if len(programConfig.injector.http.tokenEndpoint) == 0 {
+		tokenEndpoint, err := discoverTokenEndpoint(programConfig.injector.http.issuer)
+		if err != nil {
+			return "", err
+		}
+
+		programConfig.injector.http.tokenEndpoint = tokenEndpoint
+	}
+
+	token, err := requestToken(programConfig.injector.http.tokenEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+
+	// short lived tokens are used once at least
+	tokenCache.accessToken = token.AccessToken
+	tokenCache.expiresAt = time.Now().Add(max(lifetime-TOKEN_EXPIRY_MARGIN, 0))
+
+	return tokenCache.accessToken, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+/*
+ * Parquet datasets (e.g. TLC trip records as published)
+ *
+ * Rows are streamed a row group at a time, PARQUET_BATCH_ROWS at once, and
+ * turned into the very same tuples of the pre-converted csv: row number
+ * first (as the csv index column), then the columns in schema order (or the
+ * --parquet-columns ones, in that order). Timestamps are formatted as
+ * "2006-01-02 15:04:05" (UTC), floats always with a decimal point, nulls and
+ * NaNs as empty. Position (to resume from) is the number of the next row
+ */
+
+const PARQUET_BATCH_ROWS = 256
+
+type ParquetReader struct {
+	file *os.File
+	pf   *parquet.File
+
+	header     []string
+	leaves     []int // leaf column index of each header column, -1: row number
+	timestamps []*format.TimestampType
+
+	group     int
+	rows      parquet.Rows
+	groupDone bool
+	batch     []parquet.Row
+	batchLen  int
+	batchPos  int
+
+	offset int64 // number of the next row
+}
+
+func openParquet(path string, columns []string) (*ParquetReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid parquet: %w", err)
+	}
+
+	rd := &ParquetReader{
+		file:   f,
+		pf:     pf,
+		header: []string{""},
+		leaves: []int{-1},
+		batch:  make([]parquet.Row, PARQUET_BATCH_ROWS),
+	}
+	rd.timestamps = append(rd.timestamps, nil)
+
+	schema := pf.Schema()
+
+	if len(columns) == 0 {
+		for _, field := range schema.Fields() {
+			if !field.Leaf() {
+				log.Printf("ignoring parquet column %s (nested)\n", field.Name())
+				continue
+			}
+			columns = append(columns, field.Name())
+		}
+	}
+
+	for _, column := range columns {
+		leaf, found := schema.Lookup(column)
+		if !found {
+			f.Close()
+			return nil, fmt.Errorf("no column %s in parquet schema", column)
+		}
+
+		var timestamp *format.TimestampType
+		if logicalType := leaf.Node.Type().LogicalType(); logicalType != nil {
+			timestamp = logicalType.Timestamp
+		}
+
+		rd.header = append(rd.header, column)
+		rd.leaves = append(rd.leaves, leaf.ColumnIndex)
+		rd.timestamps = append(rd.timestamps, timestamp)
+	}
+
+	if len(rd.header) != len(columnNoiseGens) {
+		log.Printf("WARNING %d parquet columns, tuples of %d columns expected by the pipeline\n",
+			len(rd.header), len(columnNoiseGens))
+	}
+
+	log.Printf("parquet: %d rows in %d row groups, columns: %s\n",
+		pf.NumRows(), len(pf.RowGroups()), strings.Join(rd.header[1:], ","))
+
+	return rd, nil
+}
+
+// Jump to the row numbered offset, row group included
+func (rd *ParquetReader) seek(offset int64) error {
+	rd.closeRows()
+
+	rowGroups := rd.pf.RowGroups()
+
+	var groupStart int64
+	for rd.group = 0; rd.group < len(rowGroups); rd.group++ {
+		numRows := rowGroups[rd.group].NumRows()
+		if offset < groupStart+numRows {
+			break
+		}
+		groupStart += numRows
+	}
+
+	rd.offset = offset
+
+	if rd.group == len(rowGroups) {
+		return nil
+	}
+
+	rd.rows = rowGroups[rd.group].Rows()
+
+	return rd.rows.SeekToRow(offset - groupStart)
+}
+
+func (rd *ParquetReader) position() int64 {
+	return rd.offset
+}
+
+func (rd *ParquetReader) closeRows() {
+	if rd.rows != nil {
+		rd.rows.Close()
+	}
+	rd.rows = nil
+	rd.groupDone = false
+	rd.batchLen = 0
+	rd.batchPos = 0
+}
+
+// Next row, as csv entries of the tuple columns
+func (rd *ParquetReader) readNextLine() ([]CsvEntry, error) {
+	rowGroups := rd.pf.RowGroups()
+
+	// rows are only valid until next batch is read, group closed once done
+	for rd.batchPos >= rd.batchLen {
+		if rd.groupDone {
+			rd.closeRows()
+			rd.group++
+		}
+
+		if rd.rows == nil {
+			if rd.group >= len(rowGroups) {
+				rd.close()
+				return nil, CsvEofError{}
+			}
+
+			rd.rows = rowGroups[rd.group].Rows()
+		}
+
+		n, err := rd.rows.ReadRows(rd.batch)
+		if errors.Is(err, io.EOF) {
+			rd.groupDone = true
+		} else if err != nil {
+			rd.close()
+			return nil, err
+		}
+
+		rd.batchLen = n
+		rd.batchPos = 0
+	}
+
+	row := rd.batch[rd.batchPos]
+	rd.batchPos++
+
+	values := make(map[int]parquet.Value, len(row))
+	for _, value := range row {
+		values[value.Column()] = value
+	}
+
+	ents := []CsvEntry{}
+	for idx, leaf := range rd.leaves {
+		value := strconv.FormatInt(rd.offset, 10)
+		if leaf >= 0 {
+			value = formatParquetValue(values[leaf], rd.timestamps[idx])
+		}
+
+		ents = append(
+			ents,
+			CsvEntry{
+				columnIndex: idx,
+				columnName:  rd.header[idx],
+				value:       value,
+			})
+	}
+
+	rd.offset++
+
+	return ents, nil
+}
+
+func formatParquetFloat(f float64, bitSize int) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return ""
+	}
+
+	value := strconv.FormatFloat(f, 'f', -1, bitSize)
+	if !strings.Contains(value, ".") {
+		value += ".0"
+	}
+
+	return value
+}
+
+func formatParquetTimestamp(v int64, timestamp *format.TimestampType) string {
+	var t time.Time
+	switch {
+	case timestamp.Unit.Millis != nil:
+		t = time.UnixMilli(v)
+	case timestamp.Unit.Micros != nil:
+		t = time.UnixMicro(v)
+	default:
+		t = time.Unix(0, v)
+	}
+
+	return t.UTC().Format(time.DateTime)
+}
+
+// Legacy timestamps: nanoseconds within the day, then julian day
+func formatParquetInt96(v parquet.Value) string {
+	i96 := v.Int96()
+
+	nanos := int64(i96[1])<<32 | int64(i96[0])
+	days := int64(i96[2]) - 2440588 // julian day of unix epoch
+
+	return time.Unix(days*86400, nanos).UTC().Format(time.DateTime)
+}
+
+func formatParquetValue(v parquet.Value, timestamp *format.TimestampType) string {
+	if v.IsNull() {
+		return ""
+	}
+
+	switch v.Kind() {
+	case parquet.Boolean:
+		return strconv.FormatBool(v.Boolean())
+	case parquet.Int32:
+		return strconv.FormatInt(int64(v.Int32()), 10)
+	case parquet.Int64:
+		if timestamp != nil {
+			return formatParquetTimestamp(v.Int64(), timestamp)
+		}
+		return strconv.FormatInt(v.Int64(), 10)
+	case parquet.Int96:
+		return formatParquetInt96(v)
+	case parquet.Float:
+		return formatParquetFloat(float64(v.Float()), 32)
+	case parquet.Double:
+		return formatParquetFloat(v.Double(), 64)
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return string(v.ByteArray())
+	}
+
+	return v.String()
+}
+
+func (rd *ParquetReader) close() {
+	rd.closeRows()
+
+	if rd.file != nil {
+		rd.file.Close()
+	}
+	rd.file = nil
+}
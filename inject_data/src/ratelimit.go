@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * Token bucket rate limiter shared by the injector workers
+ *
+ * Requests are let through at rps (0: unlimited), up to burst at once.
+ * When the api pushes back (HTTP 429 or 5xx), every worker pauses for the
+ * Retry-After the api asked for (or an exponential backoff) and the rate
+ * is halved, then it recovers a bit on each request that goes through
+ */
+
+const MIN_RPS_FACTOR = 0.05      // rate is never lowered below this fraction of rps
+const RPS_RECOVERY_FACTOR = 0.05 // rate recovered on success, as a fraction of rps
+const MIN_THROTTLE_PAUSE = time.Second
+const MAX_THROTTLE_PAUSE = 30 * time.Second
+
+type RateLimiter struct {
+	mu sync.Mutex
+
+	targetRps float64
+	rps       float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+
+	pausedUntil time.Time
+	backoff     time.Duration
+}
+
+func newRateLimiter(rps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		targetRps: rps,
+		rps:       rps,
+		burst:     float64(burst),
+		tokens:    float64(burst),
+		last:      time.Now(),
+	}
+}
+
+// Block until a request may be sent
+func (rl *RateLimiter) wait() {
+	for {
+		rl.mu.Lock()
+
+		now := time.Now()
+
+		var delay time.Duration
+		if now.Before(rl.pausedUntil) {
+			delay = rl.pausedUntil.Sub(now)
+		} else if rl.rps <= 0 {
+			rl.mu.Unlock()
+			return
+		} else {
+			rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rps)
+			rl.last = now
+
+			if rl.tokens >= 1 {
+				rl.tokens--
+				rl.mu.Unlock()
+				return
+			}
+
+			delay = time.Duration((1 - rl.tokens) / rl.rps * float64(time.Second))
+		}
+
+		rl.mu.Unlock()
+
+		// caller checks whether to send anything at all
+		if !sleepUnlessStopped(delay) {
+			return
+		}
+	}
+}
+
+// The api pushed back: pause everybody and slow down
+func (rl *RateLimiter) throttle(retryAfter time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+
+	// other workers got pushed back by the same burst, already handled
+	if now.Before(rl.pausedUntil) {
+		return
+	}
+
+	rl.backoff = min(max(2*rl.backoff, MIN_THROTTLE_PAUSE), MAX_THROTTLE_PAUSE)
+
+	pause := rl.backoff
+	if retryAfter > 0 {
+		pause = min(retryAfter, MAX_THROTTLE_PAUSE)
+	}
+	rl.pausedUntil = now.Add(pause)
+
+	if rl.targetRps > 0 {
+		rl.rps = math.Max(rl.rps/2, rl.targetRps*MIN_RPS_FACTOR)
+		log.Printf(" --> Throttled by api, pausing %v, rate lowered to %.2f rps\n", pause, rl.rps)
+	} else {
+		log.Printf(" --> Throttled by api, pausing %v\n", pause)
+	}
+}
+
+// A request went through: recover rate
+func (rl *RateLimiter) succeed() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.backoff = 0
+
+	if rl.rps < rl.targetRps {
+		rl.rps = math.Min(rl.targetRps, rl.rps+rl.targetRps*RPS_RECOVERY_FACTOR)
+	}
+}
+
+func isThrottling(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// Retry-After header, either seconds or HTTP date. 0 if missing
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
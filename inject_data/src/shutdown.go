@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ * Graceful shutdown on SIGINT (CTRL+C) or SIGTERM
+ *
+ * No more rows are read nor sent, requests in flight are given up to
+ * --drain-timeout to complete (retries included), then aborted. Rows not
+ * known to be accepted are left out of the checkpoint (or back in the journal
+ * when sending failed rows), i.e. they are sent again on next run. A second
+ * signal aborts requests in flight right away
+ */
+
+const DEFAULT_DRAIN_TIMEOUT = "10s"
+
+var errInjectionStopped = errors.New("injection stopped")
+
+var shutdown struct {
+	once   sync.Once
+	stop   chan struct{}   // closed on first signal
+	ctx    context.Context // of every request, canceled when out of time
+	cancel context.CancelFunc
+}
+
+func init() {
+	shutdown.stop = make(chan struct{})
+	shutdown.ctx, shutdown.cancel = context.WithCancel(context.Background())
+}
+
+func stopRequested() bool {
+	select {
+	case <-shutdown.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sleep, unless stopped meanwhile (false)
+func sleepUnlessStopped(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-shutdown.stop:
+		return false
+	}
+}
+
+// Sleep, unless out of time to drain meanwhile (false): requests in flight
+// keep on being retried once stopped
+func sleepUnlessOutOfTime(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-shutdown.ctx.Done():
+		return false
+	}
+}
+
+func requestStop() {
+	shutdown.once.Do(func() {
+		close(shutdown.stop)
+		time.AfterFunc(programConfig.injector.drainTimeout, shutdown.cancel)
+	})
+}
+
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("%s received, waiting up to %v for requests in flight (again to abort them)\n",
+			sig, programConfig.injector.drainTimeout)
+		requestStop()
+
+		sig = <-sigs
+		log.Printf("%s received, aborting requests in flight\n", sig)
+		shutdown.cancel()
+
+		// yet another one kills the process
+		signal.Stop(sigs)
+	}()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ * HMAC signed requests (deploy -auth-mode hmac)
+ *
+ * The auth key is never sent: signature is the hex HMAC-SHA256 of
+ * "<timestamp>\n<nonce>\n<body sha256>", keyed by the hex SHA256 of the
+ * auth key. A random nonce per request lets the authorizer reject replays
+ */
+
+const AUTH_MODE_HMAC = "hmac"
+const HMAC_SCHEME = "HMAC-SHA256"
+const NONCE_BYTES = 16
+
+func newNonce() (string, error) {
+	nonceBytes := make([]byte, NONCE_BYTES)
+	if _, err := io.ReadFull(rand.Reader, nonceBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(nonceBytes), nil
+}
+
+func signRequest(req *http.Request, body []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	bodySum := sha256.Sum256(body)
+	contentSha256 := hex.EncodeToString(bodySum[:])
+
+	keySum := sha256.Sum256([]byte(programConfig.injector.http.authKey))
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(keySum[:])))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + contentSha256))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	req.Header.Add("Authorization",
+		HMAC_SCHEME+" "+programConfig.injector.http.clientId+":"+signature)
+	req.Header.Add("X-Signature-Timestamp", timestamp)
+	req.Header.Add("X-Signature-Nonce", nonce)
+	req.Header.Add("X-Content-Sha256", contentSha256)
+
+	return nil
+}
@@ -1,16 +1,20 @@
 package main
 
-import "math/rand"
-
-type TupleWiseNoiseGenerator func(*string)
+type TupleWiseNoiseGenerator struct {
+	name     string
+	callback func(*string)
+}
 
-func generateTupleWiseNoise(t *string, g *[]TupleWiseNoiseGenerator) {
+// Name of the noise generator applied, if any
+func generateTupleWiseNoise(t *string, g *[]TupleWiseNoiseGenerator) string {
 	if programConfig.generator.dirtyData {
 		for _, twngen := range *g {
-			if rand.Intn(100) == 60 {
-				twngen(t)
-				return
+			if noiseRand.IntN(100) == 60 {
+				twngen.callback(t)
+				return twngen.name
 			}
 		}
 	}
+
+	return ""
 }
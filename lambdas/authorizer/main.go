@@ -2,13 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
 )
@@ -29,13 +40,47 @@ func newSecretsManagerService() (*secretsmanager.Client, error) {
 	return secretsmanager.NewFromConfig(awsConfig), nil
 }
 
+// Secrets manager client and secret ARN, kept across invocations
+var smSvc *secretsmanager.Client
+var secretArn *string
+
 // tell secretsmanager to decrypt secret
 func getSecretValue() (string, error) {
-	smSvc, err := newSecretsManagerService()
+	if smSvc == nil {
+		var err error
+		if smSvc, err = newSecretsManagerService(); err != nil {
+			return "", err
+		}
+	}
+
+	if secretArn == nil {
+		var err error
+		if secretArn, err = getSecretArn(); err != nil {
+			return "", err
+		}
+	}
+
+	// Got the crypto-storage ARN, so we obtain the plaintext secret
+	gsvi := secretsmanager.GetSecretValueInput{
+		SecretId: secretArn,
+	}
+	gsvo, err := smSvc.GetSecretValue(dflCtx(), &gsvi)
 	if err != nil {
+		// secret may have been deleted and created again
+		secretArn = nil
 		return "", err
 	}
 
+	// secrets created via CloudFormation (see deploy export) can only be
+	// strings, while the deployment program stores a binary secret
+	if gsvo.SecretBinary == nil && gsvo.SecretString != nil {
+		return *gsvo.SecretString, nil
+	}
+
+	return string(gsvo.SecretBinary), nil
+}
+
+func getSecretArn() (*string, error) {
 	// We will need the ARN of the cryptographic storage to
 	// be able to use it
 	// IMPORTANT: name in Values array needs to be changed if
@@ -52,42 +97,287 @@ func getSecretValue() (string, error) {
 	}
 	lso, err := smSvc.ListSecrets(dflCtx(), &lsi)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(lso.SecretList) == 0 {
-		return "", errors.New("SecretList is empty")
+		return nil, errors.New("SecretList is empty")
 	}
 
-	// Got the crypto-storage ARN, so we obtain the plaintext secret
-	gsvi := secretsmanager.GetSecretValueInput{
-		SecretId: lso.SecretList[0].ARN,
+	return lso.SecretList[0].ARN, nil
+}
+
+// Client of keys stored as plain secrets (not a registry)
+const DEFAULT_CLIENT_ID = "default"
+
+// Key registry stored by the deployment program (see ../../deploy/src/keys.go)
+type apiKey struct {
+	ClientId string     `json:"clientId"`
+	Hash     string     `json:"hash"` // hex encoded SHA256 of the key
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+type keyRegistry struct {
+	Mode string   `json:"mode,omitempty"` // AUTH_MODE_KEY if empty
+	Keys []apiKey `json:"keys"`
+}
+
+type AuthorizationResponse struct {
+	IsAuthorized bool              `json:"isAuthorized"`
+	Context      map[string]string `json:"context,omitempty"`
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// The registry, or the plain secret as the key of DEFAULT_CLIENT_ID
+func parseSecret(secret string) *keyRegistry {
+	var registry keyRegistry
+	if err := json.Unmarshal([]byte(secret), &registry); err != nil || registry.Keys == nil {
+		return &keyRegistry{
+			Keys: []apiKey{{ClientId: DEFAULT_CLIENT_ID, Hash: hashKey(secret)}},
+		}
 	}
-	gsvo, err := smSvc.GetSecretValue(dflCtx(), &gsvi)
+
+	return &registry
+}
+
+/*
+ * Keys are cached by the (warm) lambda instance and fetched again from the
+ * secrets manager every SECRET_REFRESH_SECONDS (env variable, see
+ * ../../deploy/src/config.go): keys added, rotated or revoked take up to
+ * that long to be seen. Invocations of an instance are never concurrent
+ */
+const DEFAULT_SECRET_REFRESH = 5 * time.Minute
+
+var cachedKeys *keyRegistry
+var cachedKeysTime time.Time
+var secretRefresh = getSecretRefresh()
+
+func getSecretRefresh() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SECRET_REFRESH_SECONDS"))
+	if err != nil || seconds < 0 {
+		return DEFAULT_SECRET_REFRESH
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func getKeys() (*keyRegistry, error) {
+	if cachedKeys != nil && time.Since(cachedKeysTime) < secretRefresh {
+		return cachedKeys, nil
+	}
+
+	secret, err := getSecretValue()
 	if err != nil {
-		return "", err
+		// keep on using the previous keys, if any, rather than denying everything
+		if cachedKeys != nil {
+			log.Printf("unable to refresh secret, using cached keys: %v\n", err)
+			return cachedKeys, nil
+		}
+		return nil, err
 	}
 
-	return string(gsvo.SecretBinary), nil
+	cachedKeys = parseSecret(secret)
+	cachedKeysTime = time.Now()
+
+	return cachedKeys, nil
 }
 
-type AuthorizationResponse struct {
-	IsAuthorized bool `json:"isAuthorized"`
+func isExpired(key *apiKey, now time.Time) bool {
+	return key.Expires != nil && key.Expires.Before(now)
+}
+
+// Client id the key belongs to, nil if the key is unknown (or expired).
+// Hashes are compared in constant time, all of them, so that timing tells
+// nothing about the keys
+func lookupClient(keys []apiKey, key string) *string {
+	hash := []byte(hashKey(key))
+	now := time.Now()
+
+	var clientId *string
+	for i := range keys {
+		match := subtle.ConstantTimeCompare([]byte(keys[i].Hash), hash) == 1
+		if match && !isExpired(&keys[i], now) {
+			clientId = &keys[i].ClientId
+		}
+	}
+
+	return clientId
+}
+
+/*
+ * Signed requests (auth mode hmac, see ../../deploy/src/signing.go)
+ *
+ * "Authorization" header is "HMAC-SHA256 <clientId>:<signature>", signature
+ * being the hex HMAC-SHA256 of "<timestamp>\n<nonce>\n<body sha256>", keyed
+ * by the hex SHA256 of the client key (i.e. its hash in the registry, which is
+ * all it takes to sign). Timestamps out of MAX_CLOCK_SKEW and nonces already
+ * seen are rejected. The body is never seen here: the body sha256 signed is
+ * checked against the body by the validate lambda (see ../validate)
+ * IMPORTANT: NONCE_TABLE needs to be changed if table name changes
+ *            (see ../../deploy/src/config.go)
+ */
+const AUTH_MODE_HMAC = "hmac"
+const HMAC_SCHEME = "HMAC-SHA256 "
+const MAX_CLOCK_SKEW = 5 * time.Minute
+const NONCE_TABLE = "authNonces"
+const MIN_NONCE_LEN = 16
+const MAX_NONCE_LEN = 128
+
+// payload format 2.0 headers are lowercase
+const (
+	TIMESTAMP_HEADER      = "x-signature-timestamp"
+	NONCE_HEADER          = "x-signature-nonce"
+	CONTENT_SHA256_HEADER = "x-content-sha256"
+)
+
+var ddbSvc *dynamodb.Client
+
+func getSignature(signingKey string, timestamp string, nonce string, contentSha256 string) []byte {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + contentSha256))
+	return mac.Sum(nil)
+}
+
+// Record the nonce, false if it has already been seen. Nonces expire along
+// with the timestamp they were signed with
+func recordNonce(clientId string, nonce string, timestamp time.Time) (bool, error) {
+	if ddbSvc == nil {
+		awsConfig, err := config.LoadDefaultConfig(
+			dflCtx(),
+			config.WithRegion(os.Getenv("AWS_REGION")))
+		if err != nil {
+			return false, err
+		}
+
+		ddbSvc = dynamodb.NewFromConfig(awsConfig)
+	}
+
+	expiresAt := timestamp.Add(MAX_CLOCK_SKEW).Unix()
+
+	pii := dynamodb.PutItemInput{
+		TableName: aws.String(NONCE_TABLE),
+		Item: map[string]ddbtypes.AttributeValue{
+			"Nonce":     &ddbtypes.AttributeValueMemberS{Value: clientId + "/" + nonce},
+			"ExpiresAt": &ddbtypes.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(Nonce)"),
+	}
+
+	_, err := ddbSvc.PutItem(dflCtx(), &pii)
+	if err != nil {
+		var condFailed *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Client id the request has been signed by, nil if the signature is not
+// valid (or the request is a replay)
+func verifySignedRequest(keys []apiKey, headers map[string]string) (*string, error) {
+	credential, found := strings.CutPrefix(headers["authorization"], HMAC_SCHEME)
+	if !found {
+		return nil, nil
+	}
+
+	clientId, signatureHex, found := strings.Cut(credential, ":")
+	if !found {
+		return nil, nil
+	}
+
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+
+	var key *apiKey
+	for i := range keys {
+		if keys[i].ClientId == clientId && !isExpired(&keys[i], now) {
+			key = &keys[i]
+		}
+	}
+	if key == nil {
+		return nil, nil
+	}
+
+	timestampHeader := headers[TIMESTAMP_HEADER]
+	nonce := headers[NONCE_HEADER]
+	contentSha256 := headers[CONTENT_SHA256_HEADER] // checked by validate
+
+	unixTime, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	timestamp := time.Unix(unixTime, 0)
+	if timestamp.Before(now.Add(-MAX_CLOCK_SKEW)) || timestamp.After(now.Add(MAX_CLOCK_SKEW)) {
+		return nil, nil
+	}
+
+	if len(nonce) < MIN_NONCE_LEN || len(nonce) > MAX_NONCE_LEN {
+		return nil, nil
+	}
+
+	expected := getSignature(key.Hash, timestampHeader, nonce, contentSha256)
+	if !hmac.Equal(signature, expected) {
+		return nil, nil
+	}
+
+	// only for valid signatures, otherwise anyone could burn nonces
+	fresh, err := recordNonce(clientId, nonce, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		log.Printf("replayed nonce from client %s\n", clientId)
+		return nil, nil
+	}
+
+	return &key.ClientId, nil
 }
 
 // Main lambda handler
 func handler(e events.APIGatewayV2CustomAuthorizerV2Request) (AuthorizationResponse, error) {
-	realKey, err := getSecretValue()
+	registry, err := getKeys()
 	if err != nil {
 		return AuthorizationResponse{IsAuthorized: false}, err
 	}
 
-	// Check the plaintext key obtained via the secretsmanager against
-	// the one sent via HTTP (encrypted) header field "Authorization"
-	// by the client, JSON object answer will allow Authorizer to determine
-	// if allow or deny resource access
+	if len(e.IdentitySource) == 0 {
+		return AuthorizationResponse{IsAuthorized: false}, nil
+	}
+
+	// Check the key sent via HTTP (encrypted) header field "Authorization"
+	// by the client against the ones obtained via the secretsmanager (or
+	// the signature, see ../../deploy/src/signing.go), JSON object answer will allow
+	// Authorizer to determine if allow or deny resource access, and tells
+	// the client identity to the integration
+	var clientId *string
+	if registry.Mode == AUTH_MODE_HMAC {
+		clientId, err = verifySignedRequest(registry.Keys, e.Headers)
+		if err != nil {
+			return AuthorizationResponse{IsAuthorized: false}, err
+		}
+	} else {
+		clientId = lookupClient(registry.Keys, e.IdentitySource[0])
+	}
+
+	if clientId == nil {
+		return AuthorizationResponse{IsAuthorized: false}, nil
+	}
+
 	return AuthorizationResponse{
-		IsAuthorized: realKey == e.IdentitySource[0],
+		IsAuthorized: true,
+		Context:      map[string]string{"clientId": *clientId},
 	}, nil
 }
 
@@ -14,12 +14,15 @@ OUTPUT=pkgs
 
 FAILSIMFLAG=,ENABLE_FAILSIM
 
+# packages are built for each of these archs (x86_64 and arm64/Graviton
+# lambdas), may be overridden, e.g. GOARCHS=arm64 ./build-pkg.nix.sh
+GOARCHS=${GOARCHS:-"amd64 arm64"}
+
 mkdir $OUTPUT
 
 echo "+++ output directory set to $OUTPUT"
 
 export GOOS=linux
-export GOARCH=amd64
 export CGO_ENABLED=0
 
 build() {
@@ -30,17 +33,22 @@ build() {
 
         cd $l
 
-        BOOTSTRAP=../$OUTPUT/$l/bin-$GOOS-$GOARCH/bootstrap
-        ZIP=../$OUTPUT/$l/$l.zip
-        SOURCE=main.go
+        for GOARCH in $GOARCHS; do
+            export GOARCH
+
+            BOOTSTRAP=../$OUTPUT/$l/bin-$GOOS-$GOARCH/bootstrap
+            ZIP=../$OUTPUT/$l/$l-$GOARCH.zip
+            SOURCE=main.go
 
-        echo " - building"
-        go build -tags=lambda.norpc$FAILSIMFLAG -o $BOOTSTRAP $SOURCE
+            echo " - building ($GOARCH)"
+            go build -tags=lambda.norpc$FAILSIMFLAG -o $BOOTSTRAP $SOURCE
 
-        echo " - packaging"
-        zip -r -j $ZIP $BOOTSTRAP
+            echo " - packaging ($GOARCH)"
+            rm -f $ZIP
+            zip -r -j $ZIP $BOOTSTRAP
 
-        echo " + package $OUTPUT/$l/$l.zip ready to upload"
+            echo " + package $OUTPUT/$l/$l-$GOARCH.zip ready to upload"
+        done
 
         cd ..
     done
@@ -17,9 +17,12 @@ md %OUTPUT%
 echo +++ output directory set to %OUTPUT%
 
 set GOOS=linux
-set GOARCH=amd64
 set CGO_ENABLED=0
 
+rem packages are built for each of these archs (x86_64 and arm64/Graviton
+rem lambdas), may be overridden, e.g. set GOARCHS=arm64
+if not defined GOARCHS set GOARCHS=amd64 arm64
+
 set start=0
 set end=6
 
@@ -58,18 +61,22 @@ for /l %%i in (!start!,1,!end!) do (
 
     cd !lambdas[%%i]!
 
-    set BOOTSTRAP_DIR=../%OUTPUT%/!lambdas[%%i]!/bin-%GOOS%-%GOARCH%
-    set SOURCE=main.go
+    for %%a in (%GOARCHS%) do (
+        set GOARCH=%%a
+        set BOOTSTRAP_DIR=../%OUTPUT%/!lambdas[%%i]!/bin-%GOOS%-%%a
+        set SOURCE=main.go
 
-    echo  - building
-    go build -tags=lambda.norpc!failsimflag! -o !BOOTSTRAP_DIR!/bootstrap !SOURCE!
+        echo  - building (%%a^)
+        go build -tags=lambda.norpc!failsimflag! -o !BOOTSTRAP_DIR!/bootstrap !SOURCE!
 
-    echo  - packaging
+        echo  - packaging (%%a^)
 
-    cd !BOOTSTRAP_DIR!
-    tar.exe -a -c -f ../!lambdas[%%i]!.zip bootstrap
+        pushd !BOOTSTRAP_DIR!
+        tar.exe -a -c -f ../!lambdas[%%i]!-%%a.zip bootstrap
+        popd
 
-    echo  + package %OUTPUT%/!lambdas[%%i]!/!lambdas[%%i]!.zip ready to upload
+        echo  + package %OUTPUT%/!lambdas[%%i]!/!lambdas[%%i]!-%%a.zip ready to upload
+    )
 
-    cd ../../..
+    cd ..
 )
\ No newline at end of file
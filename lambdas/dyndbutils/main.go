@@ -7,6 +7,7 @@ package dyndbutils
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -22,16 +23,24 @@ type tupleStatus struct {
 	StoreRequestId uint64 `dynamodbav:"StoreRequestId"`
 	RawTuple       string `dynamodbav:"RawTuple"`
 	StatusReason   int32  `dynamodbav:"StatusReason"`
+	ClientId       string `dynamodbav:"ClientId,omitempty"`
+	CreatedAt      int64  `dynamodbav:"CreatedAt"`
+	LambdaVersion  string `dynamodbav:"LambdaVersion,omitempty"`
 }
 
 /* exported */
 
 // Build a tuple with no error (transaction status: success)
-func BuildDefaultTupleStatus(id uint64, rawTuple *string) interface{} {
+// clientId identifies who sent the tuple (empty if authentication is disabled),
+// the version of the lambda building it is recorded (see deploy rollback -auto)
+func BuildDefaultTupleStatus(id uint64, rawTuple *string, clientId *string) interface{} {
 	return tupleStatus{
 		StoreRequestId: id,
 		RawTuple:       *rawTuple,
 		StatusReason:   0,
+		ClientId:       *clientId,
+		CreatedAt:      time.Now().Unix(),
+		LambdaVersion:  os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
 	}
 }
 
@@ -18,6 +18,7 @@ type TupleStoreRequest struct {
 	Reason        int    `json:"reason"`
 	TransactionId uint64 `json:"transactionId"`
 	Tuple         string `json:"tuple"`
+	ClientId      string `json:"clientId"`
 }
 
 type TupleStoreResponse struct {
@@ -148,7 +149,7 @@ func handler(e TupleStoreRequest) (TupleStoreResponse, error) {
 	// own support DynamoDB table
 	err = dyndbutils.PutInTable(
 		ddbSvc,
-		dyndbutils.BuildDefaultTupleStatus(e.TransactionId, &e.Tuple),
+		dyndbutils.BuildDefaultTupleStatus(e.TransactionId, &e.Tuple, &e.ClientId),
 		&STATUS_TABLE_NAME)
 
 	if err != nil {
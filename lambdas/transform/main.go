@@ -18,11 +18,13 @@ type TupleTransformationResponse struct {
 	Reason        int    `json:"reason"`
 	TransactionId uint64 `json:"transactionId"`
 	Tuple         string `json:"tuple"`
+	ClientId      string `json:"clientId"`
 }
 
 type TupleTransformationRequest struct {
 	TransactionId uint64 `json:"transactionId"`
 	Tuple         string `json:"tuple"`
+	ClientId      string `json:"clientId"`
 }
 
 type TransformError struct {
@@ -45,6 +47,7 @@ func validResponse(e *TupleTransformationRequest) (TupleTransformationResponse,
 		Reason:        0,
 		TransactionId: e.TransactionId,
 		Tuple:         e.Tuple,
+		ClientId:      e.ClientId,
 	}, nil
 }
 
@@ -54,6 +57,7 @@ func invalidResponse(e *TupleTransformationRequest) (TupleTransformationResponse
 		Reason:        2, // <-- Reason code for transform failure
 		TransactionId: e.TransactionId,
 		Tuple:         e.Tuple,
+		ClientId:      e.ClientId,
 	}, nil
 }
 
@@ -113,7 +117,7 @@ func handler(e TupleTransformationRequest) (TupleTransformationResponse, error)
 	// in my own support DynamoDB table
 	err = dyndbutils.PutInTable(
 		ddbSvc,
-		dyndbutils.BuildDefaultTupleStatus(e.TransactionId, &e.Tuple),
+		dyndbutils.BuildDefaultTupleStatus(e.TransactionId, &e.Tuple, &e.ClientId),
 		&TABLE_NAME)
 
 	if err != nil {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
 	"dyndbutils"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"failsim"
 	"fmt"
@@ -18,7 +21,18 @@ const CSV_NUMCOLS = 20
 
 var TABLE_NAME = "validationStatus"
 
+// API gateway either passes the request body as is or, when the client
+// identity is known (authentication enabled), wraps it as "request" along with
+// the client id returned by the authorizer (see ../../deploy/src/config.go)
+// and, for signed requests, the body sha256 they were signed with
 type TupleValidationRequest struct {
+	Tuple         string       `json:"tuple"`
+	ClientId      string       `json:"clientId"`
+	ContentSha256 string       `json:"contentSha256"`
+	Request       *RequestBody `json:"request,omitempty"`
+}
+
+type RequestBody struct {
 	Tuple string `json:"tuple"`
 }
 
@@ -27,24 +41,27 @@ type TupleValidationResponse struct {
 	Reason        int    `json:"reason"`
 	TransactionId uint64 `json:"transactionId"`
 	Tuple         string `json:"tuple"`
+	ClientId      string `json:"clientId"`
 }
 
 // returns a JSON object with no Golang "error"
-func validResponse(id uint64, rawTuple *string) (TupleValidationResponse, error) {
+func validResponse(id uint64, rawTuple *string, clientId *string) (TupleValidationResponse, error) {
 	return TupleValidationResponse{
 		Success:       true,
 		Reason:        0,
 		TransactionId: id,
 		Tuple:         *rawTuple,
+		ClientId:      *clientId,
 	}, nil
 }
 
 // returns a JSON object with no Golang "error"
-func invalidResponse(id uint64) (TupleValidationResponse, error) {
+func invalidResponse(id uint64, clientId *string) (TupleValidationResponse, error) {
 	return TupleValidationResponse{
 		Success:       false,
 		Reason:        1, // <-- Reason code for validate failure
 		TransactionId: id,
+		ClientId:      *clientId,
 	}, nil
 }
 
@@ -53,6 +70,19 @@ func erroredResponse(msg string, err error) (TupleValidationResponse, error) {
 	return TupleValidationResponse{}, fmt.Errorf("%s: %v", msg, err)
 }
 
+// The authorizer checked the signature over the body sha256 claimed, not the
+// body: the body signed is the compact JSON one, as encoding/json writes it
+func bodyMatchesSignature(body *RequestBody, contentSha256 string) bool {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return false
+	}
+
+	bodySum := sha256.Sum256(bodyBytes)
+
+	return strings.EqualFold(hex.EncodeToString(bodySum[:]), contentSha256)
+}
+
 // transactionId is calculated from:
 //   - the specific tuple (like a "weak" hashing algorithm)
 //   - the beginTime which was registered as soon as the lambda handler started
@@ -107,6 +137,15 @@ func handler(e TupleValidationRequest) (TupleValidationResponse, error) {
 	// register begin time as soon as possible
 	transactionBeginTime := time.Now().Unix()
 
+	if e.Request != nil {
+		if len(e.ContentSha256) != 0 && !bodyMatchesSignature(e.Request, e.ContentSha256) {
+			return erroredResponse("receiving input",
+				errors.New("body does not match its signed sha256"))
+		}
+
+		e.Tuple = e.Request.Tuple
+	}
+
 	// Trimming space lets lambda able to determine if tuple is empty or not
 	// errored response allows lambda to waste time and money into further
 	// computations
@@ -135,7 +174,7 @@ func handler(e TupleValidationRequest) (TupleValidationResponse, error) {
 	// (for now)
 	err = dyndbutils.PutInTable(
 		ddbSvc,
-		dyndbutils.BuildDefaultTupleStatus(transactionId, &e.Tuple),
+		dyndbutils.BuildDefaultTupleStatus(transactionId, &e.Tuple, &e.ClientId),
 		&TABLE_NAME)
 	if err != nil {
 		return erroredResponse("unable to put raw tuple", err)
@@ -145,9 +184,9 @@ func handler(e TupleValidationRequest) (TupleValidationResponse, error) {
 	// Recall: NO ERROR RETURNED AT THIS POINT, JUST A JSON OBJECT reporting whether
 	//         tuples are valid or not, and nil error
 	if fieldChecksAreOk(&fixedTuple) {
-		return validResponse(transactionId, &fixedTuple)
+		return validResponse(transactionId, &fixedTuple, &e.ClientId)
 	} else {
-		return invalidResponse(transactionId)
+		return invalidResponse(transactionId, &e.ClientId)
 	}
 }
 